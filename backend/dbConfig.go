@@ -67,6 +67,51 @@ func deleteTables(db *sql.DB) {
 		log.Fatal(err)
 	}
 
+	_, err = db.Exec(`DROP TABLE IF EXISTS ChatEvent`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS ChatInvite`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS ChatJoinRequest`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS MessageView`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS PinnedMessage`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS ChatMemberPermission`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS ThreadSubscription`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS MessageRevision`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`DROP TABLE IF EXISTS MessageHidden`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 }
 
 func setupTables(db *sql.DB) {
@@ -77,7 +122,9 @@ func setupTables(db *sql.DB) {
 		FullName VARCHAR(255) NOT NULL,
 		Handle VARCHAR(100) NOT NULL UNIQUE,
 		Phone VARCHAR(15) NOT NULL UNIQUE,
-		AvatarLink TEXT DEFAULT NULL
+		AvatarLink TEXT DEFAULT NULL,
+		LastSeen DATETIME DEFAULT NULL,
+		LastSeenPrivacy VARCHAR(10) NOT NULL DEFAULT 'everyone'
 );
 `)
 	if err != nil {
@@ -88,7 +135,17 @@ func setupTables(db *sql.DB) {
 		CREATE TABLE IF NOT EXISTS Chat (
 			ID INT PRIMARY KEY AUTO_INCREMENT,
 			Name VARCHAR(255) NOT NULL,
-			ChatType VARCHAR(10) NOT NULL
+			ChatType VARCHAR(10) NOT NULL,
+			DirectKey VARCHAR(50) DEFAULT NULL UNIQUE,
+			Handle VARCHAR(100) DEFAULT NULL UNIQUE,
+			CanSendMessages BOOLEAN NOT NULL DEFAULT TRUE,
+			CanSendMedia BOOLEAN NOT NULL DEFAULT TRUE,
+			CanAddMembers BOOLEAN NOT NULL DEFAULT FALSE,
+			CanPinMessages BOOLEAN NOT NULL DEFAULT FALSE,
+			CanChangeInfo BOOLEAN NOT NULL DEFAULT FALSE,
+			EditWindow INT NOT NULL DEFAULT 0,
+			DeleteWindow INT NOT NULL DEFAULT 0,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`)
 
 	if err != nil {
@@ -100,7 +157,27 @@ func setupTables(db *sql.DB) {
 			ID INT PRIMARY KEY AUTO_INCREMENT,
 			ChatID INT NOT NULL,
 			UserID INT NOT NULL,
-			Role VARCHAR(10) NOT NULL
+			Role VARCHAR(10) NOT NULL,
+			LastDeliveredMessageID INT NOT NULL DEFAULT 0,
+			LastReadMessageID INT NOT NULL DEFAULT 0,
+			MutedUntil DATETIME DEFAULT NULL,
+			PinnedAt DATETIME DEFAULT NULL,
+			Archived BOOLEAN NOT NULL DEFAULT FALSE,
+			NotificationLevel VARCHAR(10) NOT NULL DEFAULT 'all',
+			UNIQUE (ChatID, UserID),
+			INDEX (UserID)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ChatMemberPermission (
+			ChatID INT NOT NULL,
+			UserID INT NOT NULL,
+			Permission VARCHAR(30) NOT NULL,
+			Allowed BOOLEAN NOT NULL,
+			PRIMARY KEY (ChatID, UserID, Permission)
 		)`)
 	if err != nil {
 		log.Fatal(err)
@@ -114,9 +191,76 @@ func setupTables(db *sql.DB) {
 			TextContent VARCHAR(10000) DEFAULT NULL,
 			Timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
 			WasEdited BOOLEAN DEFAULT FALSE,
-			ReplyToId INT DEFAULT NULL
+			EditedAt DATETIME DEFAULT NULL,
+			DeletedAt DATETIME DEFAULT NULL,
+			ReplyToId INT DEFAULT NULL,
+			ThreadID INT DEFAULT NULL,
+			IsSystem BOOLEAN NOT NULL DEFAULT FALSE,
+			INDEX (ChatID, ID),
+			INDEX (ThreadID, ID)
+		)`)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS MessageRevision (
+			ID INT PRIMARY KEY AUTO_INCREMENT,
+			MessageID INT NOT NULL,
+			TextContent VARCHAR(10000) NOT NULL,
+			EditedBy INT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX (MessageID, ID)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS MessageHidden (
+			MessageID INT NOT NULL,
+			UserID INT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (MessageID, UserID),
+			INDEX (UserID, MessageID)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ThreadSubscription (
+			MessageID INT NOT NULL,
+			UserID INT NOT NULL,
+			Following BOOLEAN NOT NULL DEFAULT TRUE,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (MessageID, UserID)
 		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS MessageView (
+			MessageID INT NOT NULL,
+			UserID INT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (MessageID, UserID)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS PinnedMessage (
+			ID INT PRIMARY KEY AUTO_INCREMENT,
+			ChatID INT NOT NULL,
+			MessageID INT NOT NULL,
+			PinnedBy INT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (ChatID, MessageID)
+		)`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -126,7 +270,8 @@ func setupTables(db *sql.DB) {
 			ID INT PRIMARY KEY AUTO_INCREMENT,
 			MessageID INT NOT NULL,
 			Type VARCHAR(10) NOT NULL,
-			Link VARCHAR(10000) NOT NULL
+			Link VARCHAR(10000) NOT NULL,
+			INDEX (MessageID)
 		)`)
 	if err != nil {
 		log.Fatal(err)
@@ -144,6 +289,51 @@ func setupTables(db *sql.DB) {
 		log.Fatal(err)
 	}
 
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ChatInvite (
+			ID INT PRIMARY KEY AUTO_INCREMENT,
+			ChatID INT NOT NULL,
+			Token VARCHAR(32) NOT NULL UNIQUE,
+			CreatedBy INT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			ExpiresAt DATETIME DEFAULT NULL,
+			MaxUses INT NOT NULL DEFAULT 0,
+			Uses INT NOT NULL DEFAULT 0,
+			RequiresApproval BOOLEAN NOT NULL DEFAULT FALSE,
+			Revoked BOOLEAN NOT NULL DEFAULT FALSE,
+			INDEX (ChatID)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ChatJoinRequest (
+			ID INT PRIMARY KEY AUTO_INCREMENT,
+			ChatID INT NOT NULL,
+			UserID INT NOT NULL,
+			InviteID INT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (ChatID, UserID)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS ChatEvent (
+			ID BIGINT PRIMARY KEY AUTO_INCREMENT,
+			ChatID INT NOT NULL,
+			Type VARCHAR(50) NOT NULL,
+			Payload MEDIUMTEXT NOT NULL,
+			Created DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX (ChatID, ID),
+			INDEX (Created)
+		)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS UserInitiate (
 			ID INT PRIMARY KEY AUTO_INCREMENT,
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker carries hub messages between server instances. Every message
+// published by any instance is handed to the subscriber of every instance,
+// including the one that published it, which then delivers it to its own
+// sockets. It also counts the open connections of every user across all
+// instances, which is what presence is based on.
+type Broker interface {
+	Publish(message hubMessage) error
+	// Subscribe starts delivering messages to handler. It is called once.
+	Subscribe(handler func(message hubMessage)) error
+	// AddConnections changes the number of open connections of the user by
+	// delta and returns the new number.
+	AddConnections(userID int64, delta int64) (int64, error)
+	// Connections returns the number of open connections of the user.
+	Connections(userID int64) (int64, error)
+	Close() error
+}
+
+// newBroker picks the Redis broker when REDIS_URL is set and the in-process
+// one otherwise, which is enough as long as a single instance runs.
+func newBroker() Broker {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		return &localBroker{}
+	}
+
+	broker, err := newRedisBroker(url)
+	if err != nil {
+		log.Fatalf("error connecting to redis: %s", err.Error())
+	}
+
+	return broker
+}
+
+// localBroker hands messages straight to the subscriber of this process.
+type localBroker struct {
+	handler func(message hubMessage)
+
+	mu          sync.Mutex
+	connections map[int64]int64
+}
+
+func (b *localBroker) Publish(message hubMessage) error {
+	if b.handler != nil {
+		b.handler(message)
+	}
+
+	return nil
+}
+
+func (b *localBroker) Subscribe(handler func(message hubMessage)) error {
+	b.handler = handler
+	return nil
+}
+
+func (b *localBroker) AddConnections(userID int64, delta int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.connections == nil {
+		b.connections = make(map[int64]int64)
+	}
+	b.connections[userID] += delta
+	count := b.connections[userID]
+	if count <= 0 {
+		delete(b.connections, userID)
+	}
+
+	return count, nil
+}
+
+func (b *localBroker) Connections(userID int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.connections[userID], nil
+}
+
+func (b *localBroker) Close() error {
+	return nil
+}
+
+const (
+	// redisChannel is the pub/sub channel every instance publishes to.
+	redisChannel = "sendiz:hub"
+	// redisConnections is the hash holding the open connections per user.
+	redisConnections = "sendiz:connections"
+)
+
+// redisBroker fans messages out through Redis pub/sub and keeps the
+// connection counts in a hash. It only relies on PUBLISH, SUBSCRIBE and a
+// few hash commands, so any server speaking the Redis protocol works, e.g.
+// the redis service of docker-compose.yml or an embedded miniredis. Counts of
+// an instance that dies without closing its connections stay behind until
+// the users connect and disconnect again.
+type redisBroker struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+}
+
+func newRedisBroker(url string) (*redisBroker, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisBroker{client: client}, nil
+}
+
+func (b *redisBroker) Publish(message hubMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return b.client.Publish(context.Background(), redisChannel, data).Err()
+}
+
+func (b *redisBroker) Subscribe(handler func(message hubMessage)) error {
+	b.pubsub = b.client.Subscribe(context.Background(), redisChannel)
+	// wait for the subscription to be confirmed so nothing published after
+	// Subscribe returns is missed
+	if _, err := b.pubsub.Receive(context.Background()); err != nil {
+		return err
+	}
+
+	go func() {
+		for redisMessage := range b.pubsub.Channel() {
+			message := hubMessage{}
+			if err := json.Unmarshal([]byte(redisMessage.Payload), &message); err != nil {
+				log.Printf("error decoding hub message from redis: %s", err.Error())
+				continue
+			}
+			handler(message)
+		}
+	}()
+
+	return nil
+}
+
+func (b *redisBroker) AddConnections(userID int64, delta int64) (int64, error) {
+	ctx := context.Background()
+	field := strconv.FormatInt(userID, 10)
+
+	count, err := b.client.HIncrBy(ctx, redisConnections, field, delta).Result()
+	if err != nil {
+		return 0, err
+	}
+	if count <= 0 {
+		// a concurrent connect may have raised it again, only drop a zero
+		b.client.Eval(ctx, `if tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0") <= 0 then redis.call("HDEL", KEYS[1], ARGV[1]) end`, []string{redisConnections}, field)
+	}
+
+	return count, nil
+}
+
+func (b *redisBroker) Connections(userID int64) (int64, error) {
+	count, err := b.client.HGet(context.Background(), redisConnections, strconv.FormatInt(userID, 10)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+
+	return count, err
+}
+
+func (b *redisBroker) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+
+	return b.client.Close()
+}
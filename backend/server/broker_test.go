@@ -0,0 +1,139 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisBroker connects a broker to the embedded Redis.
+func newTestRedisBroker(t *testing.T, redis *miniredis.Miniredis) *redisBroker {
+	t.Helper()
+
+	broker, err := newRedisBroker("redis://" + redis.Addr())
+	if err != nil {
+		t.Fatalf("connecting to miniredis: %s", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+func receive(t *testing.T, messages chan hubMessage) hubMessage {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return hubMessage{}
+	}
+}
+
+func TestLocalBrokerDeliversToItself(t *testing.T) {
+	broker := &localBroker{}
+	received := []hubMessage{}
+	broker.Subscribe(func(message hubMessage) {
+		received = append(received, message)
+	})
+
+	broker.Publish(hubMessage{ChatID: 7, Data: []byte(`{}`)})
+
+	if len(received) != 1 || received[0].ChatID != 7 {
+		t.Fatalf("got %v, want the published message", received)
+	}
+}
+
+func TestRedisBrokerDeliversToEveryInstance(t *testing.T) {
+	redis := miniredis.RunT(t)
+	a := newTestRedisBroker(t, redis)
+	b := newTestRedisBroker(t, redis)
+
+	fromA := make(chan hubMessage, 1)
+	fromB := make(chan hubMessage, 1)
+	if err := a.Subscribe(func(message hubMessage) { fromA <- message }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Subscribe(func(message hubMessage) { fromB <- message }); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := hubMessage{ChatID: 3, Exclude: 5, Data: []byte(`{"v":1}`), Join: []int64{9}}
+	if err := a.Publish(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, messages := range []chan hubMessage{fromA, fromB} {
+		got := receive(t, messages)
+		if got.ChatID != sent.ChatID || got.Exclude != sent.Exclude || string(got.Data) != string(sent.Data) || len(got.Join) != 1 || got.Join[0] != 9 {
+			t.Errorf("got %+v, want %+v", got, sent)
+		}
+	}
+}
+
+func TestBrokersCountConnections(t *testing.T) {
+	redis := miniredis.RunT(t)
+	brokers := map[string]Broker{
+		"local": &localBroker{},
+		"redis": newTestRedisBroker(t, redis),
+	}
+
+	for name, broker := range brokers {
+		t.Run(name, func(t *testing.T) {
+			steps := []struct {
+				delta int64
+				want  int64
+			}{{1, 1}, {1, 2}, {-1, 1}, {-1, 0}}
+			for _, step := range steps {
+				count, err := broker.AddConnections(42, step.delta)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != step.want {
+					t.Errorf("AddConnections(%d) = %d, want %d", step.delta, count, step.want)
+				}
+			}
+
+			count, err := broker.Connections(42)
+			if err != nil || count != 0 {
+				t.Errorf("Connections = %d, %v, want 0", count, err)
+			}
+		})
+	}
+}
+
+// A user connected to two instances stays online until both connections
+// are closed.
+func TestPresenceSpansInstances(t *testing.T) {
+	redis := miniredis.RunT(t)
+	a := newHubManager(nil, newTestRedisBroker(t, redis))
+	b := newHubManager(nil, newTestRedisBroker(t, redis))
+
+	onA := &Client{id: 1}
+	onB := &Client{id: 1}
+
+	if !a.connect(onA) {
+		t.Error("first connection should bring the user online")
+	}
+	if b.connect(onB) {
+		t.Error("second connection on another instance brought the user online again")
+	}
+	if !b.isOnline(1) || !a.isOnline(1) {
+		t.Error("user should be online on both instances")
+	}
+
+	if a.disconnect(onA) {
+		t.Error("user went offline while connected to another instance")
+	}
+	if !a.isOnline(1) {
+		t.Error("user should still be online")
+	}
+	if !b.disconnect(onB) {
+		t.Error("closing the last connection should take the user offline")
+	}
+	if a.isOnline(1) {
+		t.Error("user should be offline")
+	}
+}
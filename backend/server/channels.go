@@ -0,0 +1,127 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Channels are chats where only the owner and admins post; every other member
+// is a read-only subscriber. A channel with a Handle is public: anyone can
+// find it by the handle and subscribe. Subscribers joining and leaving aren't
+// announced, and instead of read receipts a channel counts how many
+// subscribers viewed each message, one MessageView row per message and user.
+
+// recordViews counts the messages after the user's previous read watermark
+// up to messageID as viewed by the user. Rows that already exist are ignored,
+// so concurrent reads can't count a view twice.
+func recordViews(db *sql.DB, chatID, userID, fromID, toID int64) error {
+	_, err := db.Exec(`
+		INSERT IGNORE INTO MessageView (MessageID, UserID)
+		SELECT ID, ? FROM Message
+		WHERE ChatID = ? AND ID > ? AND ID <= ? AND UserID <> ?
+	`, userID, chatID, fromID, toID, userID)
+
+	return err
+}
+
+// handleGetChannelByHandle finds a public channel, for users who aren't
+// subscribed yet.
+func handleGetChannelByHandle(c *gin.Context, db *sql.DB) {
+	var chatID int64
+	err := db.QueryRow(`SELECT ID FROM Chat WHERE Handle = ? AND ChatType = ?`, c.Param("handle"), ChatTypeChannel).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "channel not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading channel"})
+		return
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading channel"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "chat": chat})
+}
+
+func handleSubscribeChannel(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var chatType string
+	var handle sql.NullString
+	err := db.QueryRow(`SELECT ChatType, Handle FROM Chat WHERE ID = ?`, chatID).Scan(&chatType, &handle)
+	if err == sql.ErrNoRows || (err == nil && (chatType != ChatTypeChannel || !handle.Valid)) {
+		c.JSON(404, gin.H{"success": false, "error": "channel not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error subscribing"})
+		return
+	}
+
+	res, err := db.Exec(`INSERT IGNORE INTO ChatMember (ChatID, UserID, Role) VALUES (?, ?, ?)`, chatID, userId, RoleMember)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error subscribing"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows > 0 {
+		announceJoin(db, hubs, chatID, userId, userId, "")
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// handleGetMessageViews returns how many subscribers viewed a channel
+// message. Only the owner and admins of the channel may ask.
+func handleGetMessageViews(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	messageID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var chatID int64
+	err := db.QueryRow(`SELECT ChatID FROM Message WHERE ID = ?`, messageID).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "message not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting views"})
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId, RoleOwner, RoleAdmin); !ok {
+		return
+	}
+
+	var views int
+	err = db.QueryRow(`SELECT COUNT(*) FROM MessageView WHERE MessageID = ?`, messageID).Scan(&views)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting views"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "views": views})
+}
@@ -2,10 +2,518 @@ package server
 
 import (
 	"database/sql"
+	"errors"
+	"log"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
 )
 
-func addChatRoutes(router *gin.RouterGroup, db *sql.DB) {
+func addChatRoutes(router *gin.RouterGroup, db *sql.DB, hubs *HubManager) {
+	chat := router.Group("/chat")
+	chat.Use(authMiddleWare)
+	{
+		chat.GET("/", func(c *gin.Context) {
+			handleGetInbox(c, db)
+		})
+		chat.POST("/", func(c *gin.Context) {
+			handleCreateChat(c, db, hubs)
+		})
+		chat.POST("/direct", func(c *gin.Context) {
+			handleOpenDirectChat(c, db, hubs)
+		})
+		chat.GET("/channel/:handle", func(c *gin.Context) {
+			handleGetChannelByHandle(c, db)
+		})
+		chat.POST("/:id/subscribe", func(c *gin.Context) {
+			handleSubscribeChannel(c, db, hubs)
+		})
+		chat.GET("/:id", func(c *gin.Context) {
+			handleGetChat(c, db)
+		})
+		chat.PUT("/:id", func(c *gin.Context) {
+			handleRenameChat(c, db, hubs)
+		})
+		chat.DELETE("/:id", func(c *gin.Context) {
+			handleDeleteChat(c, db, hubs)
+		})
+		chat.POST("/:id/members", func(c *gin.Context) {
+			handleAddMembers(c, db, hubs)
+		})
+		chat.DELETE("/:id/members/:userId", func(c *gin.Context) {
+			handleRemoveMember(c, db, hubs)
+		})
+		chat.PUT("/:id/members/:userId/role", func(c *gin.Context) {
+			handleSetMemberRole(c, db, hubs)
+		})
+		chat.POST("/:id/leave", func(c *gin.Context) {
+			handleLeaveChat(c, db, hubs)
+		})
+		chat.POST("/:id/transfer", func(c *gin.Context) {
+			handleTransferOwnership(c, db, hubs)
+		})
+		chat.PUT("/:id/limits", func(c *gin.Context) {
+			handleUpdateChatLimits(c, db, hubs)
+		})
+		chat.GET("/:id/permissions", func(c *gin.Context) {
+			handleGetChatPermissions(c, db)
+		})
+		chat.PUT("/:id/permissions", func(c *gin.Context) {
+			handleUpdateChatPermissions(c, db, hubs)
+		})
+		chat.GET("/:id/members/:userId/permissions", func(c *gin.Context) {
+			handleGetMemberPermissions(c, db)
+		})
+		chat.PUT("/:id/members/:userId/permissions", func(c *gin.Context) {
+			handleUpdateMemberPermissions(c, db, hubs)
+		})
+		chat.GET("/:id/settings", func(c *gin.Context) {
+			handleGetChatSettings(c, db)
+		})
+		chat.PUT("/:id/settings", func(c *gin.Context) {
+			handleUpdateChatSettings(c, db, hubs)
+		})
+		chat.GET("/:id/pins", func(c *gin.Context) {
+			handleListPins(c, db)
+		})
+		chat.POST("/:id/pins", func(c *gin.Context) {
+			handlePinMessage(c, db, hubs)
+		})
+		chat.DELETE("/:id/pins/:messageId", func(c *gin.Context) {
+			handleUnpinMessage(c, db, hubs)
+		})
+		chat.POST("/:id/invites", func(c *gin.Context) {
+			handleCreateInvite(c, db)
+		})
+		chat.GET("/:id/invites", func(c *gin.Context) {
+			handleListInvites(c, db)
+		})
+		chat.DELETE("/:id/invites/:inviteId", func(c *gin.Context) {
+			handleRevokeInvite(c, db)
+		})
+		chat.GET("/:id/requests", func(c *gin.Context) {
+			handleListJoinRequests(c, db)
+		})
+		chat.POST("/:id/requests/:userId", func(c *gin.Context) {
+			handleApproveJoinRequest(c, db, hubs)
+		})
+		chat.DELETE("/:id/requests/:userId", func(c *gin.Context) {
+			handleDeclineJoinRequest(c, db)
+		})
+		chat.POST("/:id/delivered", func(c *gin.Context) {
+			handleMarkChat(c, db, hubs, ReceiptDelivered)
+		})
+		chat.POST("/:id/read", func(c *gin.Context) {
+			handleMarkChat(c, db, hubs, ReceiptRead)
+		})
+	}
+}
+
+const (
+	ChatTypeGroup   = "group"
+	ChatTypeDirect  = "direct"  // exactly two members, no name, see direct_chat.go
+	ChatTypeChannel = "channel" // only owners and admins post, see channels.go
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+const maxChatNameLength = 255
+
+var errNotMember = errors.New("not a member of this chat")
+
+// getMemberRole returns the role of the user in the chat, or sql.ErrNoRows
+// if the user isn't a member.
+func getMemberRole(db *sql.DB, chatID, userID int64) (string, error) {
+	var role string
+	err := db.QueryRow(`SELECT Role FROM ChatMember WHERE ChatID = ? AND UserID = ?`, chatID, userID).Scan(&role)
+
+	return role, err
+}
+
+func getChatType(db *sql.DB, chatID int64) (string, error) {
+	var chatType string
+	err := db.QueryRow(`SELECT ChatType FROM Chat WHERE ID = ?`, chatID).Scan(&chatType)
+
+	return chatType, err
+}
+
+// requireRole checks that the user is a member of the chat with one of the
+// given roles, or any role if none are given. On failure it writes the
+// response and returns false.
+func requireRole(c *gin.Context, db *sql.DB, chatID, userID int64, roles ...string) (string, bool) {
+	role, err := getMemberRole(db, chatID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(403, gin.H{"success": false, "error": errNotMember.Error(), "code": ErrorCodeNotMember})
+		return "", false
+	}
+	if err != nil {
+		log.Printf("error getting role in chat %d: %s", chatID, err.Error())
+		c.JSON(500, gin.H{"success": false, "error": "error checking membership"})
+		return "", false
+	}
+
+	if len(roles) == 0 {
+		return role, true
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return role, true
+		}
+	}
+
+	c.JSON(403, gin.H{"success": false, "error": "your role in this chat doesn't allow this", "code": ErrorCodePermissionDenied})
+	return role, false
+}
+
+// getChat loads a chat with its members. Channels only list their owner
+// and admins.
+func getChat(db *sql.DB, chatID int64) (Chat, error) {
+	chat := Chat{}
+	err := db.QueryRow(`
+		SELECT ID, Name, ChatType, COALESCE(Handle, ''), (SELECT COUNT(*) FROM ChatMember WHERE ChatID = Chat.ID), EditWindow, DeleteWindow
+		FROM Chat
+		WHERE ID = ?
+	`, chatID).Scan(&chat.ID, &chat.Name, &chat.ChatType, &chat.Handle, &chat.SubscriberCount, &chat.EditWindow, &chat.DeleteWindow)
+	if err != nil {
+		return chat, err
+	}
+
+	// subscribers of a channel are only counted
+	isChannel := chat.ChatType == ChatTypeChannel
+	if !isChannel {
+		chat.SubscriberCount = 0
+	}
+	if chat.ChatType == ChatTypeGroup {
+		chat.Permissions, err = getChatPermissions(db, chatID)
+		if err != nil {
+			return chat, err
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT u.ID, u.FullName, u.Handle, COALESCE(u.AvatarLink, ''), cm.Role
+		FROM ChatMember cm
+		JOIN User u ON u.ID = cm.UserID
+		WHERE cm.ChatID = ? AND NOT (? AND cm.Role = ?)
+		ORDER BY cm.ID
+	`, chatID, isChannel, RoleMember)
+	if err != nil {
+		return chat, err
+	}
+	defer rows.Close()
+
+	chat.Members = []User{}
+	for rows.Next() {
+		user := User{}
+		if err := rows.Scan(&user.ID, &user.FullName, &user.Handle, &user.AvatarLink, &user.Role); err != nil {
+			return chat, err
+		}
+		chat.Members = append(chat.Members, user)
+	}
+
+	return chat, rows.Err()
+}
+
+func handleCreateChat(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Name     string  `json:"name"`
+		ChatType string  `json:"chatType"`
+		Handle   string  `json:"handle"` // channels only, makes the channel public
+		Members  []int64 `json:"members"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+
+	reqBody.Name = strings.TrimSpace(reqBody.Name)
+	if reqBody.Name == "" || len(reqBody.Name) > maxChatNameLength {
+		c.JSON(400, gin.H{"success": false, "error": "name is required and at most 255 characters long"})
+		return
+	}
+	if reqBody.ChatType == "" {
+		reqBody.ChatType = ChatTypeGroup
+	}
+	if reqBody.ChatType != ChatTypeGroup && reqBody.ChatType != ChatTypeChannel {
+		// direct chats are opened through POST /chat/direct
+		c.JSON(400, gin.H{"success": false, "error": "invalid chatType"})
+		return
+	}
+
+	var handle interface{}
+	if reqBody.Handle != "" {
+		if reqBody.ChatType != ChatTypeChannel || !isValidHandle(reqBody.Handle) {
+			c.JSON(400, gin.H{"success": false, "error": "invalid handle"})
+			return
+		}
+		handle = reqBody.Handle
+	}
+
+	// the creator is the owner, everyone else joins as a plain member
+	memberIds := []int64{userId}
+	seen := map[int64]bool{userId: true}
+	for _, memberId := range reqBody.Members {
+		if !seen[memberId] {
+			seen[memberId] = true
+			memberIds = append(memberIds, memberId)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO Chat (Name, ChatType, Handle) VALUES (?, ?, ?)`, reqBody.Name, reqBody.ChatType, handle)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+		c.JSON(409, gin.H{"success": false, "error": "handle is already taken"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating chat"})
+		return
+	}
+	chatID, err := res.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating chat"})
+		return
+	}
+
+	for i, memberId := range memberIds {
+		role := RoleMember
+		if i == 0 {
+			role = RoleOwner
+		}
+
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM User WHERE ID = ?)`, memberId).Scan(&exists); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error creating chat"})
+			return
+		}
+		if !exists {
+			c.JSON(400, gin.H{"success": false, "error": "unknown member"})
+			return
+		}
+
+		_, err = tx.Exec(`INSERT INTO ChatMember (ChatID, UserID, Role) VALUES (?, ?, ?)`, chatID, memberId, role)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error creating chat"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating chat"})
+		return
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return
+	}
+
+	hubs.join(chatID, memberIds)
+	hubs.publish(chatID, EventChatCreated, chat)
+
+	c.JSON(200, gin.H{"success": true, "chat": chat})
+}
+
+func handleGetChat(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "chat": chat})
+}
+
+func handleRenameChat(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Name string `json:"name"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+	reqBody.Name = strings.TrimSpace(reqBody.Name)
+	if reqBody.Name == "" || len(reqBody.Name) > maxChatNameLength {
+		c.JSON(400, gin.H{"success": false, "error": "name is required and at most 255 characters long"})
+		return
+	}
+
+	chatType, err := getChatType(db, chatID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error renaming chat"})
+		return
+	}
+	if chatType == ChatTypeDirect {
+		c.JSON(400, gin.H{"success": false, "error": "direct chats have no editable name"})
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionChangeInfo) {
+		return
+	}
+
+	_, err = db.Exec(`UPDATE Chat SET Name = ? WHERE ID = ?`, reqBody.Name, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error renaming chat"})
+		return
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return
+	}
+	hubs.publish(chatID, EventChatUpdated, chat)
+
+	c.JSON(200, gin.H{"success": true, "chat": chat})
+}
+
+func handleDeleteChat(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	chatType, err := getChatType(db, chatID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error deleting chat"})
+		return
+	}
+
+	// either side may delete a direct chat, groups only by their owner
+	if chatType == ChatTypeDirect {
+		if _, ok := requireRole(c, db, chatID, userId); !ok {
+			return
+		}
+	} else if _, ok := requireRole(c, db, chatID, userId, RoleOwner); !ok {
+		return
+	}
+
+	memberIds, err := getChatMemberIds(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error deleting chat"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error deleting chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE a FROM Attachament a JOIN Message m ON m.ID = a.MessageID WHERE m.ChatID = ?`,
+		`DELETE v FROM MessageView v JOIN Message m ON m.ID = v.MessageID WHERE m.ChatID = ?`,
+		`DELETE t FROM ThreadSubscription t JOIN Message m ON m.ID = t.MessageID WHERE m.ChatID = ?`,
+		`DELETE r FROM MessageRevision r JOIN Message m ON m.ID = r.MessageID WHERE m.ChatID = ?`,
+		`DELETE h FROM MessageHidden h JOIN Message m ON m.ID = h.MessageID WHERE m.ChatID = ?`,
+		`DELETE FROM Message WHERE ChatID = ?`,
+		`DELETE FROM ChatMember WHERE ChatID = ?`,
+		`DELETE FROM ChatMemberPermission WHERE ChatID = ?`,
+		`DELETE FROM ChatInvite WHERE ChatID = ?`,
+		`DELETE FROM PinnedMessage WHERE ChatID = ?`,
+		`DELETE FROM ChatJoinRequest WHERE ChatID = ?`,
+		`DELETE FROM Chat WHERE ID = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, chatID); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error deleting chat"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error deleting chat"})
+		return
+	}
+
+	// tell the members before their sockets stop receiving the chat
+	hubs.publish(chatID, EventChatDeleted, ChatDeletedPayload{ID: chatID})
+	hubs.leave(chatID, memberIds)
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+type ChatDeletedPayload struct {
+	ID int64 `json:"id"`
+}
+
+func getChatMemberIds(db *sql.DB, chatID int64) ([]int64, error) {
+	rows, err := db.Query(`SELECT UserID FROM ChatMember WHERE ChatID = ?`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIds := []int64{}
+	for rows.Next() {
+		var userId int64
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		userIds = append(userIds, userId)
+	}
 
+	return userIds, rows.Err()
 }
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"expvar"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What happens to a client whose send queue is full.
+const (
+	SlowConsumerDisconnect = "disconnect" // close the socket, the client resumes after reconnecting
+	SlowConsumerDrop       = "drop"       // drop the frame and keep the client
+)
+
+// wsConfig holds the WebSocket tuning knobs. Every field can be overridden
+// with the environment variable named next to it.
+type wsConfig struct {
+	pingInterval       time.Duration // WS_PING_INTERVAL, must be shorter than pongWait
+	pongWait           time.Duration // WS_PONG_WAIT, a peer silent for longer is considered dead
+	writeWait          time.Duration // WS_WRITE_WAIT, deadline of a single write
+	sendQueueSize      int           // WS_SEND_QUEUE_SIZE
+	maxMessageSize     int64         // WS_MAX_MESSAGE_SIZE, in bytes
+	slowConsumerPolicy string        // WS_SLOW_CONSUMER_POLICY, disconnect or drop
+}
+
+func loadWsConfig() *wsConfig {
+	config := &wsConfig{
+		pingInterval:       getEnvDuration("WS_PING_INTERVAL", 30*time.Second),
+		pongWait:           getEnvDuration("WS_PONG_WAIT", 60*time.Second),
+		writeWait:          getEnvDuration("WS_WRITE_WAIT", 10*time.Second),
+		sendQueueSize:      int(getEnvInt("WS_SEND_QUEUE_SIZE", 256)),
+		maxMessageSize:     getEnvInt("WS_MAX_MESSAGE_SIZE", 64*1024),
+		slowConsumerPolicy: os.Getenv("WS_SLOW_CONSUMER_POLICY"),
+	}
+
+	if config.slowConsumerPolicy != SlowConsumerDrop {
+		config.slowConsumerPolicy = SlowConsumerDisconnect
+	}
+
+	if config.pingInterval >= config.pongWait {
+		log.Printf("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT, using %s", config.pongWait*9/10)
+		config.pingInterval = config.pongWait * 9 / 10
+	}
+
+	return config
+}
+
+// counters exposed on /debug/vars of the debug listener, see serveDebug
+var (
+	wsConnections       = expvar.NewInt("ws_connections")
+	wsDroppedFrames     = expvar.NewInt("ws_dropped_frames")
+	wsSlowConsumerKicks = expvar.NewInt("ws_slow_consumer_disconnects")
+	wsDeadPeers         = expvar.NewInt("ws_dead_peers")
+)
+
+// enqueue queues a frame for the writer without ever blocking. If the queue
+// is full the frame is dropped and, depending on the slow consumer policy,
+// the connection is closed.
+func (client *Client) enqueue(data []byte) bool {
+	select {
+	case client.send <- data:
+		return true
+	default:
+	}
+
+	wsDroppedFrames.Add(1)
+	if client.config.slowConsumerPolicy == SlowConsumerDisconnect {
+		log.Printf("disconnecting slow consumer, user %d", client.id)
+		wsSlowConsumerKicks.Add(1)
+		client.close()
+	} else {
+		log.Printf("dropping frame for user %d: send queue full", client.id)
+	}
+
+	return false
+}
+
+// close shuts the socket down, which ends both pumps. It is safe to call
+// several times and from any goroutine.
+func (client *Client) close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		if client.socket != nil {
+			client.socket.Close()
+		}
+	})
+}
+
+// readPump reads commands until the socket fails or the peer stops answering
+// pings. Every pong or frame pushes the read deadline out by pongWait.
+func (client *Client) readPump() {
+	defer client.close()
+
+	client.socket.SetReadLimit(client.config.maxMessageSize)
+	client.socket.SetReadDeadline(time.Now().Add(client.config.pongWait))
+	client.socket.SetPongHandler(func(string) error {
+		return client.socket.SetReadDeadline(time.Now().Add(client.config.pongWait))
+	})
+
+	for {
+		_, msg, err := client.socket.ReadMessage()
+		if err != nil {
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				wsDeadPeers.Add(1)
+				log.Printf("no pong from user %d, closing connection", client.id)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Println(err)
+			}
+			return
+		}
+		client.socket.SetReadDeadline(time.Now().Add(client.config.pongWait))
+
+		dispatch(client, msg)
+	}
+}
+
+// writePump is the only goroutine writing to the socket. It forwards queued
+// frames and sends a ping every pingInterval.
+func (client *Client) writePump() {
+	ticker := time.NewTicker(client.config.pingInterval)
+	defer func() {
+		ticker.Stop()
+		client.close()
+	}()
+
+	for {
+		select {
+		case message := <-client.send:
+			client.socket.SetWriteDeadline(time.Now().Add(client.config.writeWait))
+			if err := client.socket.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Println(err)
+				return
+			}
+		case <-ticker.C:
+			client.socket.SetWriteDeadline(time.Now().Add(client.config.writeWait))
+			if err := client.socket.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-client.done:
+			return
+		}
+	}
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+
+	return duration
+}
+
+func getEnvInt(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number <= 0 {
+		log.Printf("invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+
+	return number
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Messages are deleted in one of two ways. Deleting for me hides the message
+// from one member's history, inbox and threads and nobody else notices.
+// Deleting for everyone turns the message into a tombstone: it keeps its ID,
+// position, author and place in threads, so replies still point somewhere,
+// but loses its text, revisions, pin and attachaments. It is only allowed
+// within the chat's delete window, for authors and moderators alike.
+
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+var errDeleteWindowExpired = errors.New("this message can't be deleted for everyone anymore")
+
+type MessageHiddenPayload struct {
+	ID int64 `json:"id"`
+}
+
+// deleteMessage deletes a message on behalf of actorID, mode being
+// DeleteForMe or DeleteForEveryone.
+func deleteMessage(db *sql.DB, hubs *HubManager, actorID, messageID int64, mode string) error {
+	message := Message{ID: messageID}
+	err := db.QueryRow("SELECT ChatID, UserID FROM Message WHERE ID = ?", messageID).Scan(&message.ChatID, &message.UserID)
+	if err == sql.ErrNoRows {
+		return errMessageNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if mode == DeleteForMe {
+		return hideMessage(db, hubs, actorID, message)
+	}
+
+	return tombstoneMessage(db, hubs, actorID, message)
+}
+
+// hideMessage hides the message for the actor and tells their other
+// connections with message.hidden.
+func hideMessage(db *sql.DB, hubs *HubManager, actorID int64, message Message) error {
+	if _, err := getMemberRole(db, message.ChatID, actorID); err == sql.ErrNoRows {
+		return errNotMember
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`INSERT IGNORE INTO MessageHidden (MessageID, UserID) VALUES (?, ?)`, message.ID, actorID); err != nil {
+		return err
+	}
+
+	data, err := newEvent(EventMessageHidden, message.ChatID, MessageHiddenPayload{ID: message.ID})
+	if err != nil {
+		return err
+	}
+	hubs.sendToUser(actorID, data)
+
+	return nil
+}
+
+// tombstoneMessage deletes the message for everyone and publishes the
+// tombstone as message.deleted. Deleting a tombstone again does nothing.
+func tombstoneMessage(db *sql.DB, hubs *HubManager, actorID int64, message Message) error {
+	if err := authorizeMessageChange(db, actorID, message); err != nil {
+		return err
+	}
+	passed, err := windowPassed(db, message.ID, "DeleteWindow")
+	if err != nil {
+		return err
+	}
+	if passed {
+		return errDeleteWindowExpired
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE Message SET TextContent = NULL, DeletedAt = NOW() WHERE ID = ? AND DeletedAt IS NULL", message.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("DELETE FROM Attachament WHERE MessageID = ?", message.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM MessageRevision WHERE MessageID = ?", message.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM MessageView WHERE MessageID = ?", message.ID); err != nil {
+		return err
+	}
+	res, err = tx.Exec("DELETE FROM PinnedMessage WHERE MessageID = ?", message.ID)
+	if err != nil {
+		return err
+	}
+	unpinned, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	tombstone, err := getMessage(db, message.ID)
+	if err != nil {
+		return err
+	}
+	if unpinned > 0 {
+		hubs.publish(message.ChatID, EventMessageUnpinned, MessageUnpinnedPayload{MessageID: message.ID})
+	}
+	hubs.publish(message.ChatID, EventMessageDeleted, tombstone)
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Direct chats are deduplicated through Chat.DirectKey, a unique column set
+// to "<lower user id>:<higher user id>". Two concurrent requests for the same
+// pair race on that index: one insert wins, the other fails with a duplicate
+// key error and reads the winner's chat instead.
+
+const mysqlErrDuplicateEntry = 1062
+
+func directKey(userId, otherUserId int64) string {
+	if userId > otherUserId {
+		userId, otherUserId = otherUserId, userId
+	}
+
+	return fmt.Sprintf("%d:%d", userId, otherUserId)
+}
+
+// handleOpenDirectChat returns the direct chat between the caller and userId,
+// creating it if there is none yet.
+func handleOpenDirectChat(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		UserID int64 `json:"userId"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+	if reqBody.UserID == userId {
+		c.JSON(400, gin.H{"success": false, "error": "can't open a direct chat with yourself"})
+		return
+	}
+
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM User WHERE ID = ?)`, reqBody.UserID).Scan(&exists); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error opening direct chat"})
+		return
+	}
+	if !exists {
+		c.JSON(404, gin.H{"success": false, "error": "user not found"})
+		return
+	}
+
+	key := directKey(userId, reqBody.UserID)
+	chatID, created, err := getOrCreateDirectChat(db, key, userId, reqBody.UserID)
+	if err != nil {
+		log.Printf("error opening direct chat %s: %s", key, err.Error())
+		c.JSON(500, gin.H{"success": false, "error": "error opening direct chat"})
+		return
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return
+	}
+
+	if created {
+		hubs.join(chatID, []int64{userId, reqBody.UserID})
+		hubs.publish(chatID, EventChatCreated, chat)
+	}
+
+	c.JSON(200, gin.H{"success": true, "chat": chat, "created": created})
+}
+
+func getOrCreateDirectChat(db *sql.DB, key string, userId, otherUserId int64) (int64, bool, error) {
+	chatID, err := getDirectChatID(db, key)
+	if err == nil {
+		return chatID, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO Chat (Name, ChatType, DirectKey) VALUES ('', ?, ?)`, ChatTypeDirect, key)
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry {
+		// created by a concurrent request in the meantime
+		tx.Rollback()
+		chatID, err := getDirectChatID(db, key)
+		return chatID, false, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	chatID, err = res.LastInsertId()
+	if err != nil {
+		return 0, false, err
+	}
+
+	for _, memberId := range []int64{userId, otherUserId} {
+		_, err = tx.Exec(`INSERT INTO ChatMember (ChatID, UserID, Role) VALUES (?, ?, ?)`, chatID, memberId, RoleMember)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	return chatID, true, tx.Commit()
+}
+
+func getDirectChatID(db *sql.DB, key string) (int64, error) {
+	var chatID int64
+	err := db.QueryRow(`SELECT ID FROM Chat WHERE DirectKey = ?`, key).Scan(&chatID)
+
+	return chatID, err
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// Every frame on /ws, in both directions, is a JSON envelope:
+//
+//	{"v": 1, "type": "message.created", "id": "c-42", "chat": 7, "seq": 1031, "payload": {...}}
+//
+//	v        protocol version, frames with another version are refused
+//	type     event type sent by the server, or command type sent by the client
+//	id       optional, set by the client on commands and echoed on the frame answering it
+//	chat     ID of the Chat the frame is about, omitted when it isn't about a chat
+//	seq      sequence number of logged chat events, see below
+//	payload  type specific body
+//
+// Server to client events:
+//
+//	message.created      payload: Message
+//	message.edited       payload: Message
+//	message.deleted      payload: Message, the tombstone: content cleared, deletedAt set
+//	message.hidden       payload: {"id": ...}, sent to the member's own connections after deleting for them
+//	message.pinned       payload: {"messageId": ..., "pinnedBy": ..., "pinnedAt": ...}
+//	message.unpinned     payload: {"messageId": ...}
+//	chat.created         payload: Chat, the members are subscribed to it right before
+//	chat.updated         payload: Chat
+//	chat.deleted         payload: {"id": ...}, the members are unsubscribed right after
+//	chat.member_added    payload: ChatMember, the user is subscribed to the chat right before
+//	chat.member_updated  payload: ChatMember, after a role change
+//	chat.member_removed  payload: {"userId": ...}, the user is unsubscribed right after
+//	settings.updated     payload: ChatSettings, sent to the member's own connections
+//	notification         payload: {"message": Message, "mentions": ...}, sent to members whose settings allow it
+//	typing.start         payload: {"userId": ...}, relayed to the other members
+//	typing.stop          payload: {"userId": ...}, also sent when a typing.start expires
+//	receipt.delivered    payload: {"userId": ..., "messageId": ...}, the member got everything up to messageId
+//	receipt.read         payload: {"userId": ..., "messageId": ...}, the member read everything up to messageId
+//	presence.changed     payload: {"userId": ..., "online": ..., "lastSeen": ...}, sent to users sharing a chat
+//	resumed              payload: {"replayed": ..., "seq": ...}, answer to resume once the replay is sent
+//	resync.required      answer to resume when the missed events can't be replayed
+//	ack                  payload: {"messageId": ..., "timestamp": ...}, answer to message.* commands
+//	pong                 answer to ping, no payload
+//	error                payload: {"code": "...", "message": "...", "permission": "..."}
+//
+// Client to server commands:
+//
+//	ping                 no payload
+//	typing.start         chat set, no payload; repeat while the user keeps typing
+//	typing.stop          chat set, no payload
+//	chat.delivered       chat set, payload: {"messageId": ...}
+//	chat.read            chat set, payload: {"messageId": ...}
+//	resume               payload: {"lastSeq": ...}
+//	message.send         chat set, payload: Message (content, attachaments, replyTo)
+//	message.edit         payload: {"messageId": ..., "text": ...}
+//	message.delete       payload: {"messageId": ..., "for": "me" or "everyone" (default)}
+//
+// Chat events (message.*, chat.*, receipt.*) are logged and carry a seq that
+// grows monotonically across all chats, and live ones of a chat arrive in
+// seq order; typing, presence, settings, notification and message.hidden
+// events are ephemeral and have none. After reconnecting a client sends
+// resume with the highest seq it has seen. The server replays every logged
+// event of the client's chats after it, then answers with resumed. If the gap
+// is too large it answers with resync.required instead and the client has to
+// reload over REST. Live events may arrive while the replay is running,
+// clients should drop events whose seq they already handled.
+//
+// New commands are added with registerCommand; the read loop of wsHandler
+// doesn't need to change.
+const protocolVersion = 1
+
+// server to client events
+const (
+	EventMessageCreated      = "message.created"
+	EventMessageEdited       = "message.edited"
+	EventMessageDeleted      = "message.deleted"
+	EventMessageHidden       = "message.hidden"
+	EventMessagePinned       = "message.pinned"
+	EventMessageUnpinned     = "message.unpinned"
+	EventChatCreated         = "chat.created"
+	EventChatUpdated         = "chat.updated"
+	EventChatDeleted         = "chat.deleted"
+	EventChatMemberAdded     = "chat.member_added"
+	EventChatMemberUpdated   = "chat.member_updated"
+	EventChatMemberRemoved   = "chat.member_removed"
+	EventChatSettingsUpdated = "settings.updated"
+	EventNotification        = "notification"
+	EventTypingStart         = "typing.start"
+	EventTypingStop          = "typing.stop"
+	EventPresenceChanged     = "presence.changed"
+	EventReceiptDelivered    = "receipt.delivered"
+	EventReceiptRead         = "receipt.read"
+	EventResumed             = "resumed"
+	EventResyncRequired      = "resync.required"
+	EventAck                 = "ack"
+	EventPong                = "pong"
+	EventError               = "error"
+)
+
+// client to server commands
+const (
+	CommandPing          = "ping"
+	CommandTypingStart   = "typing.start"
+	CommandTypingStop    = "typing.stop"
+	CommandChatDelivered = "chat.delivered"
+	CommandChatRead      = "chat.read"
+	CommandResume        = "resume"
+	CommandMessageSend   = "message.send"
+	CommandMessageEdit   = "message.edit"
+	CommandMessageDelete = "message.delete"
+)
+
+// codes of error frames; REST errors about auth, membership, permissions and
+// messages carry them as "code" too
+const (
+	ErrorCodeBadFrame         = "bad_frame"
+	ErrorCodeBadVersion       = "unsupported_version"
+	ErrorCodeUnknownType      = "unknown_type"
+	ErrorCodeBadPayload       = "bad_payload"
+	ErrorCodeInternal         = "internal_error"
+	ErrorCodeNotMember        = "not_member"
+	ErrorCodeNotAuthor        = "not_author"
+	ErrorCodeNotFound         = "not_found"
+	ErrorCodeInvalidMessage   = "invalid_message"
+	ErrorCodeWindowExpired    = "window_expired"
+	ErrorCodePermissionDenied = "permission_denied"
+	ErrorCodeUnauthorized     = "unauthorized" // REST only, sockets are authenticated before the upgrade
+)
+
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	ChatID  int64           `json:"chat,omitempty"`
+	Seq     int64           `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Permission string `json:"permission,omitempty"` // the missing one, for permission_denied
+}
+
+// wsError is returned by command handlers to send a specific error frame
+// instead of a generic internal_error.
+type wsError struct {
+	code       string
+	message    string
+	permission string
+}
+
+func (e *wsError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func newWsError(code, message string) *wsError {
+	return &wsError{code: code, message: message}
+}
+
+// commandHandler handles one client command. Anything it wants to answer
+// with it sends through client.sendEvent.
+type commandHandler func(client *Client, env Envelope) error
+
+var commandHandlers = map[string]commandHandler{}
+
+// registerCommand makes the dispatcher route frames of the given type to handler.
+func registerCommand(commandType string, handler commandHandler) {
+	commandHandlers[commandType] = handler
+}
+
+func init() {
+	registerCommand(CommandPing, func(client *Client, env Envelope) error {
+		return client.sendEvent(Envelope{Type: EventPong, ID: env.ID})
+	})
+}
+
+// newEvent builds the serialized envelope of a server event.
+func newEvent(eventType string, chatID int64, payload interface{}) ([]byte, error) {
+	env := Envelope{Type: eventType, ChatID: chatID}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+
+	return marshalEnvelope(env)
+}
+
+func marshalEnvelope(env Envelope) ([]byte, error) {
+	env.Version = protocolVersion
+	return json.Marshal(env)
+}
+
+// dispatch decodes a frame read from the socket and runs the matching command
+// handler. Failures are reported back to the client as error frames.
+func dispatch(client *Client, frame []byte) {
+	env := Envelope{}
+	if err := json.Unmarshal(frame, &env); err != nil {
+		client.sendError("", newWsError(ErrorCodeBadFrame, "frame is not a valid envelope"))
+		return
+	}
+
+	if env.Version != protocolVersion {
+		client.sendError(env.ID, newWsError(ErrorCodeBadVersion, "unsupported protocol version"))
+		return
+	}
+
+	handler, ok := commandHandlers[env.Type]
+	if !ok {
+		client.sendError(env.ID, newWsError(ErrorCodeUnknownType, "unknown command "+env.Type))
+		return
+	}
+
+	if err := handler(client, env); err != nil {
+		client.sendError(env.ID, err)
+	}
+}
+
+// sendEvent queues an envelope for this client only.
+func (client *Client) sendEvent(env Envelope) error {
+	data, err := marshalEnvelope(env)
+	if err != nil {
+		return err
+	}
+
+	client.enqueue(data)
+
+	return nil
+}
+
+func (client *Client) sendError(id string, err error) {
+	var target *wsError
+	if !errors.As(err, &target) {
+		log.Printf("error handling command of user %d: %s", client.id, err.Error())
+		target = newWsError(ErrorCodeInternal, "internal error")
+	}
+
+	payload, _ := json.Marshal(ErrorPayload{Code: target.code, Message: target.message, Permission: target.permission})
+	client.sendEvent(Envelope{Type: EventError, ID: id, Payload: payload})
+}
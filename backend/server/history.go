@@ -0,0 +1,184 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Keyset pagination of message history, see handleGetMessages. A cursor is
+// the ID of the first or last message of a page, encoded so clients treat
+// it as opaque. Pages are per user: messages the user deleted for
+// themselves are left out.
+
+const (
+	messagePageSize    = 50
+	maxMessagePageSize = 100
+	cursorPrefix       = "m:"
+
+	// condition on Message leaving out what a user hid, takes the user ID
+	notHidden = `ID NOT IN (SELECT MessageID FROM MessageHidden WHERE UserID = ?)`
+)
+
+type messagePage struct {
+	messages      []Message // oldest first
+	hasMoreBefore bool
+	hasMoreAfter  bool
+}
+
+func encodeCursor(messageID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(messageID, 10)))
+}
+
+// decodeCursor returns the message ID of a cursor. If the cursor is invalid
+// it answers 400 and returns false.
+func decodeCursor(c *gin.Context, cursor string) (int64, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(data), cursorPrefix) {
+		id, err := strconv.ParseInt(strings.TrimPrefix(string(data), cursorPrefix), 10, 64)
+		if err == nil && id >= 0 {
+			return id, true
+		}
+	}
+
+	c.JSON(400, gin.H{"success": false, "error": "invalid cursor"})
+	return 0, false
+}
+
+// pageCursors returns the cursors to the pages before and after a page, ""
+// where there are none. They point past the first and last message of the
+// page. An empty page, e.g. after the newest message or when the user hid
+// every message asked for, takes them from the IDs it was asked with:
+// beforeID, or afterID, for getMessagesBefore or getMessagesAfter.
+func pageCursors(page messagePage, beforeID, afterID int64) (string, string) {
+	var prevCursor, nextCursor string
+
+	if page.hasMoreBefore {
+		switch {
+		case len(page.messages) > 0:
+			prevCursor = encodeCursor(page.messages[0].ID)
+		case afterID > 0:
+			// everything up to and including afterID
+			prevCursor = encodeCursor(afterID + 1)
+		case beforeID > 0:
+			prevCursor = encodeCursor(beforeID)
+		}
+	}
+	if page.hasMoreAfter {
+		switch {
+		case len(page.messages) > 0:
+			nextCursor = encodeCursor(page.messages[len(page.messages)-1].ID)
+		case beforeID > 0:
+			// everything from beforeID on
+			nextCursor = encodeCursor(beforeID - 1)
+		case afterID > 0:
+			nextCursor = encodeCursor(afterID)
+		}
+	}
+
+	return prevCursor, nextCursor
+}
+
+// queryMessages runs a query selecting messageColumns and scans the rows.
+func queryMessages(db *sql.DB, query string, args ...interface{}) ([]Message, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		message := Message{}
+		if err := scanMessage(rows, &message); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func reverseMessages(messages []Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
+
+func hasMessages(db *sql.DB, query string, args ...interface{}) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Message WHERE `+query+`)`, args...).Scan(&exists)
+
+	return exists, err
+}
+
+// getMessagesBefore returns up to limit messages older than beforeID, or
+// the latest ones if beforeID is 0.
+func getMessagesBefore(db *sql.DB, chatID, userID, beforeID int64, limit int) (messagePage, error) {
+	page := messagePage{}
+
+	var err error
+	if beforeID == 0 {
+		page.messages, err = queryMessages(db, `SELECT `+messageColumns+` FROM Message WHERE ChatID = ? AND `+notHidden+` ORDER BY ID DESC LIMIT ?`, chatID, userID, limit+1)
+	} else {
+		page.messages, err = queryMessages(db, `SELECT `+messageColumns+` FROM Message WHERE ChatID = ? AND ID < ? AND `+notHidden+` ORDER BY ID DESC LIMIT ?`, chatID, beforeID, userID, limit+1)
+	}
+	if err != nil {
+		return page, err
+	}
+
+	// one more row than asked for tells whether there are more
+	if len(page.messages) > limit {
+		page.messages = page.messages[:limit]
+		page.hasMoreBefore = true
+	}
+	reverseMessages(page.messages)
+
+	if beforeID != 0 {
+		page.hasMoreAfter, err = hasMessages(db, `ChatID = ? AND ID >= ? AND `+notHidden, chatID, beforeID, userID)
+	}
+
+	return page, err
+}
+
+// getMessagesAfter returns up to limit messages newer than afterID.
+func getMessagesAfter(db *sql.DB, chatID, userID, afterID int64, limit int) (messagePage, error) {
+	page := messagePage{}
+
+	var err error
+	page.messages, err = queryMessages(db, `SELECT `+messageColumns+` FROM Message WHERE ChatID = ? AND ID > ? AND `+notHidden+` ORDER BY ID LIMIT ?`, chatID, afterID, userID, limit+1)
+	if err != nil {
+		return page, err
+	}
+
+	if len(page.messages) > limit {
+		page.messages = page.messages[:limit]
+		page.hasMoreAfter = true
+	}
+
+	page.hasMoreBefore, err = hasMessages(db, `ChatID = ? AND ID <= ? AND `+notHidden, chatID, afterID, userID)
+
+	return page, err
+}
+
+// getMessagesAround returns the message with the given ID, up to half of
+// limit messages before it and the rest after it.
+func getMessagesAround(db *sql.DB, chatID, userID, messageID int64, limit int) (messagePage, error) {
+	before, err := getMessagesBefore(db, chatID, userID, messageID, limit/2)
+	if err != nil {
+		return before, err
+	}
+	after, err := getMessagesAfter(db, chatID, userID, messageID-1, limit-limit/2)
+	if err != nil {
+		return after, err
+	}
+
+	return messagePage{
+		messages:      append(before.messages, after.messages...),
+		hasMoreBefore: before.hasMoreBefore,
+		hasMoreAfter:  after.hasMoreAfter,
+	}, nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, id := range []int64{0, 1, 42, 1 << 40} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+		got, ok := decodeCursor(c, encodeCursor(id))
+		if !ok || got != id {
+			t.Errorf("decodeCursor(encodeCursor(%d)) = %d, %v", id, got, ok)
+		}
+	}
+}
+
+func TestDecodeCursorRefusesGarbage(t *testing.T) {
+	cursors := []string{
+		"",
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("42")),
+		base64.RawURLEncoding.EncodeToString([]byte("m:")),
+		base64.RawURLEncoding.EncodeToString([]byte("m:abc")),
+		base64.RawURLEncoding.EncodeToString([]byte("m:-1")),
+	}
+
+	for _, cursor := range cursors {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+
+		if _, ok := decodeCursor(c, cursor); ok {
+			t.Errorf("decodeCursor(%q) accepted it", cursor)
+		}
+		if recorder.Code != 400 {
+			t.Errorf("decodeCursor(%q) answered %d, want 400", cursor, recorder.Code)
+		}
+	}
+}
+
+func messageIDs(ids ...int64) []Message {
+	messages := []Message{}
+	for _, id := range ids {
+		messages = append(messages, Message{ID: id})
+	}
+
+	return messages
+}
+
+func TestPageCursors(t *testing.T) {
+	tests := []struct {
+		name              string
+		page              messagePage
+		beforeID, afterID int64
+		prev, next        int64 // -1 for no cursor
+	}{
+		{
+			name: "latest page",
+			page: messagePage{messages: messageIDs(5, 6, 7), hasMoreBefore: true},
+			prev: 5, next: -1,
+		},
+		{
+			name: "only page",
+			page: messagePage{messages: messageIDs(1, 2)},
+			prev: -1, next: -1,
+		},
+		{
+			name:     "middle page",
+			page:     messagePage{messages: messageIDs(5, 6), hasMoreBefore: true, hasMoreAfter: true},
+			beforeID: 7,
+			prev:     5, next: 6,
+		},
+		{
+			name:    "after the newest message",
+			page:    messagePage{messages: []Message{}, hasMoreBefore: true},
+			afterID: 9,
+			prev:    10, next: -1,
+		},
+		{
+			name:     "before the oldest message",
+			page:     messagePage{messages: []Message{}, hasMoreAfter: true},
+			beforeID: 3,
+			prev:     -1, next: 2,
+		},
+		{
+			name:     "before the first message ever",
+			page:     messagePage{messages: []Message{}, hasMoreAfter: true},
+			beforeID: 1,
+			prev:     -1, next: 0,
+		},
+		{
+			name:     "everything around hidden",
+			page:     messagePage{messages: []Message{}, hasMoreBefore: true, hasMoreAfter: true},
+			beforeID: 8, afterID: 7,
+			prev: 8, next: 7,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prev, next := pageCursors(test.page, test.beforeID, test.afterID)
+			checkCursor(t, "prevCursor", prev, test.prev)
+			checkCursor(t, "nextCursor", next, test.next)
+		})
+	}
+}
+
+func checkCursor(t *testing.T, name, cursor string, want int64) {
+	t.Helper()
+
+	if want < 0 {
+		if cursor != "" {
+			t.Errorf("%s = %q, want none", name, cursor)
+		}
+		return
+	}
+	if cursor != encodeCursor(want) {
+		t.Errorf("%s = %q, want the cursor of %d", name, cursor, want)
+	}
+}
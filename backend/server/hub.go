@@ -0,0 +1,318 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+)
+
+// newHub creates the hub for a single chat. Call run in its own goroutine
+// before registering clients.
+func newHub(id int64) *Hub {
+	return &Hub{
+		id:         id,
+		broadcast:  make(chan hubMessage),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		stop:       make(chan struct{}),
+		clients:    make(map[*Client]bool),
+	}
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+		case client := <-h.unregister:
+			delete(h.clients, client)
+		case message := <-h.broadcast:
+			for client := range h.clients {
+				if message.Exclude != 0 && client.id == message.Exclude {
+					continue
+				}
+				// never block the hub on a single slow socket
+				client.enqueue(message.Data)
+			}
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// newHubManager creates the manager and subscribes it to the broker, through
+// which every broadcast goes so that it reaches sockets on other instances too.
+func newHubManager(db *sql.DB, broker Broker) *HubManager {
+	m := &HubManager{
+		db:     db,
+		broker: broker,
+		hubs:   make(map[int64]*Hub),
+		users:  make(map[int64]map[*Client]bool),
+		typing: make(map[typingKey]*typingState),
+	}
+
+	if err := broker.Subscribe(m.deliver); err != nil {
+		log.Fatalf("error subscribing to broker: %s", err.Error())
+	}
+
+	return m
+}
+
+// addToHub registers the client with the hub of the chat, starting the hub
+// on first use. The caller must hold m.mu.
+func (m *HubManager) addToHub(chatID int64, client *Client) {
+	hub, ok := m.hubs[chatID]
+	if !ok {
+		hub = newHub(chatID)
+		m.hubs[chatID] = hub
+		go hub.run()
+	}
+
+	hub.register <- client
+	hub.subscribers++
+}
+
+// removeFromHub unregisters the client from the hub of the chat and stops
+// the hub once nobody is left. The caller must hold m.mu.
+func (m *HubManager) removeFromHub(chatID int64, client *Client) {
+	hub, ok := m.hubs[chatID]
+	if !ok {
+		return
+	}
+
+	hub.unregister <- client
+	hub.subscribers--
+	if hub.subscribers == 0 {
+		delete(m.hubs, chatID)
+		close(hub.stop)
+	}
+}
+
+// subscribe registers the client with the hubs of the given chats.
+func (m *HubManager) subscribe(client *Client, chatIDs []int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, chatID := range chatIDs {
+		if client.chats[chatID] {
+			continue
+		}
+		client.chats[chatID] = true
+		m.addToHub(chatID, client)
+	}
+}
+
+// connect records an open connection of the client's user. It reports
+// whether it is the first one on any instance, i.e. the user just came
+// online.
+func (m *HubManager) connect(client *Client) bool {
+	m.mu.Lock()
+	connections, ok := m.users[client.id]
+	if !ok {
+		connections = make(map[*Client]bool)
+		m.users[client.id] = connections
+	}
+	connections[client] = true
+	local := len(connections)
+	m.mu.Unlock()
+
+	count, err := m.broker.AddConnections(client.id, 1)
+	if err != nil {
+		log.Printf("error counting connections of user %d: %s", client.id, err.Error())
+		return local == 1
+	}
+
+	return count == 1
+}
+
+// disconnect forgets a connection recorded by connect. It reports whether
+// it was the last one on any instance, i.e. the user went offline.
+func (m *HubManager) disconnect(client *Client) bool {
+	m.mu.Lock()
+	connections, ok := m.users[client.id]
+	if !ok || !connections[client] {
+		m.mu.Unlock()
+		return false
+	}
+	delete(connections, client)
+	local := len(connections)
+	if local == 0 {
+		delete(m.users, client.id)
+	}
+	m.mu.Unlock()
+
+	count, err := m.broker.AddConnections(client.id, -1)
+	if err != nil {
+		log.Printf("error counting connections of user %d: %s", client.id, err.Error())
+		return local == 0
+	}
+
+	return count <= 0
+}
+
+// isOnline reports whether the user has at least one open connection on
+// any instance.
+func (m *HubManager) isOnline(userID int64) bool {
+	count, err := m.broker.Connections(userID)
+	if err != nil {
+		log.Printf("error counting connections of user %d: %s", userID, err.Error())
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(m.users[userID]) > 0
+	}
+
+	return count > 0
+}
+
+// sendToUser pushes data to every connection of the user.
+func (m *HubManager) sendToUser(userID int64, data []byte) {
+	m.publishToBroker(hubMessage{UserID: userID, Data: data})
+}
+
+// deliverToUser pushes data to the connections of the user on this instance.
+func (m *HubManager) deliverToUser(userID int64, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for client := range m.users[userID] {
+		client.enqueue(data)
+	}
+}
+
+// isSubscribed reports whether the client receives the events of the chat.
+func (m *HubManager) isSubscribed(client *Client, chatID int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return client.chats[chatID]
+}
+
+// chatIDs returns the chats the client is subscribed to.
+func (m *HubManager) chatIDs(client *Client) []int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	chatIDs := make([]int64, 0, len(client.chats))
+	for chatID := range client.chats {
+		chatIDs = append(chatIDs, chatID)
+	}
+
+	return chatIDs
+}
+
+// unsubscribe removes the client from every hub it was registered with.
+func (m *HubManager) unsubscribe(client *Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for chatID := range client.chats {
+		m.removeFromHub(chatID, client)
+		delete(client.chats, chatID)
+	}
+}
+
+// broadcast pushes data to every client connected to the chat.
+func (m *HubManager) broadcast(chatID int64, data []byte) {
+	m.broadcastExcept(chatID, 0, data)
+}
+
+// broadcastExcept works like broadcast but skips every connection of the
+// given user.
+func (m *HubManager) broadcastExcept(chatID int64, exclude int64, data []byte) {
+	m.publishToBroker(hubMessage{ChatID: chatID, Exclude: exclude, Data: data})
+}
+
+func (m *HubManager) publishToBroker(message hubMessage) {
+	if err := m.broker.Publish(message); err != nil {
+		log.Printf("error publishing to broker: %s", err.Error())
+	}
+}
+
+// deliver is the broker subscriber: it hands a message to the sockets
+// connected to this instance.
+func (m *HubManager) deliver(message hubMessage) {
+	if len(message.Join) > 0 || len(message.Leave) > 0 {
+		m.updateSubscriptions(message.ChatID, message.Join, message.Leave)
+		return
+	}
+
+	if message.UserID != 0 {
+		m.deliverToUser(message.UserID, message.Data)
+		return
+	}
+
+	m.mu.Lock()
+	hub, ok := m.hubs[message.ChatID]
+	m.mu.Unlock()
+
+	if !ok {
+		// nobody of this chat is connected here
+		return
+	}
+
+	select {
+	case hub.broadcast <- message:
+	case <-hub.stop:
+		// the last client left meanwhile
+	}
+}
+
+// publish stores a typed event in the chat's event log and sends it, with
+// its sequence number, to every client connected to the chat. Clients get
+// the logged events of a chat in seq order, see logEvent.
+func (m *HubManager) publish(chatID int64, eventType string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("error encoding %s event: %s", eventType, err.Error())
+		return
+	}
+
+	send := func(seq int64) {
+		event, err := marshalEnvelope(Envelope{Type: eventType, ChatID: chatID, Seq: seq, Payload: data})
+		if err != nil {
+			log.Printf("error encoding %s event: %s", eventType, err.Error())
+			return
+		}
+		m.broadcast(chatID, event)
+	}
+
+	if err := logEvent(m.db, chatID, eventType, data, send); err != nil {
+		// still deliver it live, it just can't be replayed
+		log.Printf("error logging %s event: %s", eventType, err.Error())
+		send(0)
+	}
+}
+
+// join subscribes every connection of the users, on every instance, to the chat.
+func (m *HubManager) join(chatID int64, userIDs []int64) {
+	m.publishToBroker(hubMessage{ChatID: chatID, Join: userIDs})
+}
+
+// leave unsubscribes every connection of the users, on every instance, from the chat.
+func (m *HubManager) leave(chatID int64, userIDs []int64) {
+	m.publishToBroker(hubMessage{ChatID: chatID, Leave: userIDs})
+}
+
+func (m *HubManager) updateSubscriptions(chatID int64, join []int64, leave []int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, userID := range join {
+		for client := range m.users[userID] {
+			if !client.chats[chatID] {
+				client.chats[chatID] = true
+				m.addToHub(chatID, client)
+			}
+		}
+	}
+
+	for _, userID := range leave {
+		for client := range m.users[userID] {
+			if client.chats[chatID] {
+				delete(client.chats, chatID)
+				m.removeFromHub(chatID, client)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleGetInbox lists the caller's chats: the ones pinned to the top in the
+// order they were pinned, then the others most recently active first.
+// Archived chats are left out, unless ?archived=true asks for only them.
+// Messages the user deleted for themselves are never the last message, and
+// neither they nor tombstones count as unread. The chats, their last
+// message, the unread counts and the peer of direct chats come from a single
+// query; the attachaments of the last messages from a second one, whatever
+// the number of chats.
+func handleGetInbox(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+
+	archived := c.Query("archived") == "true"
+
+	rows, err := db.Query(`
+		SELECT c.ID, c.Name, c.ChatType, cm.Role, cm.LastReadMessageID,
+			COALESCE(cm.MutedUntil > NOW(), FALSE), IF(cm.MutedUntil > NOW(), cm.MutedUntil, NULL),
+			cm.PinnedAt IS NOT NULL, cm.Archived, cm.NotificationLevel,
+			(SELECT COUNT(*) FROM Message um WHERE um.ChatID = c.ID AND um.ID > cm.LastReadMessageID AND um.UserID <> cm.UserID
+				AND um.DeletedAt IS NULL AND um.ID NOT IN (SELECT MessageID FROM MessageHidden WHERE UserID = cm.UserID)),
+			COALESCE(p.ID, 0), COALESCE(p.FullName, ''), COALESCE(p.Handle, ''), COALESCE(p.AvatarLink, ''),
+			COALESCE(m.ID, 0), COALESCE(m.UserID, 0), COALESCE(m.TextContent, ''), COALESCE(m.Timestamp, ''),
+			COALESCE(m.WasEdited, FALSE), COALESCE(m.ReplyToId, 0), COALESCE(m.IsSystem, FALSE), m.DeletedAt
+		FROM ChatMember cm
+		JOIN Chat c ON c.ID = cm.ChatID
+		LEFT JOIN Message m ON m.ID = (
+			SELECT MAX(ID) FROM Message
+			WHERE ChatID = c.ID AND ID NOT IN (SELECT MessageID FROM MessageHidden WHERE UserID = cm.UserID)
+		)
+		LEFT JOIN ChatMember pm ON c.ChatType = ? AND pm.ChatID = c.ID AND pm.UserID <> cm.UserID
+		LEFT JOIN User p ON p.ID = pm.UserID
+		WHERE cm.UserID = ? AND cm.Archived = ?
+		ORDER BY cm.PinnedAt IS NULL, cm.PinnedAt, COALESCE(m.Timestamp, c.Created) DESC, c.ID DESC
+	`, ChatTypeDirect, userId, archived)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting chats"})
+		return
+	}
+	defer rows.Close()
+
+	chats := []InboxChat{}
+	lastMessageIDs := []int64{}
+	for rows.Next() {
+		chat := InboxChat{}
+		peer := User{}
+		message := Message{}
+		var mutedUntil, deletedAt sql.NullString
+		err := rows.Scan(&chat.ID, &chat.Name, &chat.ChatType, &chat.Role, &chat.LastReadMessageID,
+			&chat.Muted, &mutedUntil, &chat.Pinned, &chat.Archived, &chat.NotificationLevel, &chat.UnreadCount,
+			&peer.ID, &peer.FullName, &peer.Handle, &peer.AvatarLink,
+			&message.ID, &message.UserID, &message.TextContent, &message.Timestamp,
+			&message.WasEdited, &message.ReplyToId, &message.IsSystem, &deletedAt)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error getting chats"})
+			return
+		}
+
+		if mutedUntil.Valid {
+			chat.MutedUntil = &mutedUntil.String
+		}
+		if deletedAt.Valid {
+			message.DeletedAt = &deletedAt.String
+		}
+		if peer.ID != 0 {
+			chat.Peer = &peer
+		}
+		if message.ID != 0 {
+			message.ChatID = chat.ID
+			message.Attachaments = []Attachament{}
+			chat.LastMessage = &message
+			lastMessageIDs = append(lastMessageIDs, message.ID)
+		}
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting chats"})
+		return
+	}
+
+	attachaments, err := getAttachaments(db, lastMessageIDs)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting chats"})
+		return
+	}
+	for _, chat := range chats {
+		if chat.LastMessage != nil && attachaments[chat.LastMessage.ID] != nil {
+			chat.LastMessage.Attachaments = attachaments[chat.LastMessage.ID]
+		}
+	}
+
+	c.JSON(200, gin.H{"success": true, "chats": chats})
+}
@@ -0,0 +1,471 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Invite links let users join a group without being added by an admin. A
+// link is a random token with an optional expiry and use limit; a use is
+// counted when a user joins or asks to join through it. Links that require
+// approval only create a ChatJoinRequest, which is approved or declined.
+// Links and requests are managed by whoever holds the addMembers permission.
+
+func addInviteRoutes(router *gin.RouterGroup, db *sql.DB, hubs *HubManager) {
+	invite := router.Group("/invite")
+	invite.Use(authMiddleWare)
+	{
+		invite.GET("/:token", func(c *gin.Context) {
+			handlePreviewInvite(c, db)
+		})
+		invite.POST("/:token/join", func(c *gin.Context) {
+			handleJoinByInvite(c, db, hubs)
+		})
+	}
+}
+
+const inviteColumns = `ID, ChatID, Token, CreatedBy, Created, ExpiresAt, MaxUses, Uses, RequiresApproval, Revoked`
+
+func scanInvite(row interface{ Scan(...interface{}) error }, invite *ChatInvite) error {
+	var expiresAt sql.NullString
+	err := row.Scan(&invite.ID, &invite.ChatID, &invite.Token, &invite.CreatedBy, &invite.Created, &expiresAt, &invite.MaxUses, &invite.Uses, &invite.RequiresApproval, &invite.Revoked)
+	if err != nil {
+		return err
+	}
+
+	invite.ExpiresAt = nil
+	if expiresAt.Valid {
+		invite.ExpiresAt = &expiresAt.String
+	}
+
+	return nil
+}
+
+// inviteUsable is the SQL condition for a link that can still be used.
+const inviteUsable = `Revoked = FALSE AND (ExpiresAt IS NULL OR ExpiresAt > NOW()) AND (MaxUses = 0 OR Uses < MaxUses)`
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getUsableInvite loads the invite of a token, answering 404 and returning
+// false if it doesn't exist or can't be used anymore.
+func getUsableInvite(c *gin.Context, db *sql.DB, token string) (ChatInvite, bool) {
+	invite := ChatInvite{}
+	err := scanInvite(db.QueryRow(`SELECT `+inviteColumns+` FROM ChatInvite WHERE Token = ? AND `+inviteUsable, token), &invite)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "invite link is invalid or expired"})
+		return invite, false
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading invite link"})
+		return invite, false
+	}
+
+	return invite, true
+}
+
+func handleCreateInvite(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		ExpiresIn        int64 `json:"expiresIn"` // seconds, 0 for a link that doesn't expire
+		MaxUses          int   `json:"maxUses"`
+		RequiresApproval bool  `json:"requiresApproval"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+	if reqBody.ExpiresIn < 0 || reqBody.MaxUses < 0 {
+		c.JSON(400, gin.H{"success": false, "error": "expiresIn and maxUses can't be negative"})
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating invite link"})
+		return
+	}
+
+	res, err := db.Exec(`
+		INSERT INTO ChatInvite (ChatID, Token, CreatedBy, ExpiresAt, MaxUses, RequiresApproval)
+		VALUES (?, ?, ?, IF(? > 0, NOW() + INTERVAL ? SECOND, NULL), ?, ?)
+	`, chatID, token, userId, reqBody.ExpiresIn, reqBody.ExpiresIn, reqBody.MaxUses, reqBody.RequiresApproval)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating invite link"})
+		return
+	}
+	inviteID, err := res.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating invite link"})
+		return
+	}
+
+	invite := ChatInvite{}
+	if err := scanInvite(db.QueryRow(`SELECT `+inviteColumns+` FROM ChatInvite WHERE ID = ?`, inviteID), &invite); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error creating invite link"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "invite": invite})
+}
+
+// handleListInvites returns the links of a chat that haven't been revoked,
+// including expired and used up ones.
+func handleListInvites(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	rows, err := db.Query(`SELECT `+inviteColumns+` FROM ChatInvite WHERE ChatID = ? AND Revoked = FALSE ORDER BY ID DESC`, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting invite links"})
+		return
+	}
+	defer rows.Close()
+
+	invites := []ChatInvite{}
+	for rows.Next() {
+		invite := ChatInvite{}
+		if err := scanInvite(rows, &invite); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error getting invite links"})
+			return
+		}
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting invite links"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "invites": invites})
+}
+
+func handleRevokeInvite(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	inviteID, ok := getIdParam(c, "inviteId")
+	if !ok {
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	res, err := db.Exec(`UPDATE ChatInvite SET Revoked = TRUE WHERE ID = ? AND ChatID = ?`, inviteID, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error revoking invite link"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		var exists bool
+		db.QueryRow(`SELECT EXISTS (SELECT 1 FROM ChatInvite WHERE ID = ? AND ChatID = ?)`, inviteID, chatID).Scan(&exists)
+		if !exists {
+			c.JSON(404, gin.H{"success": false, "error": "invite link not found"})
+			return
+		}
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// handlePreviewInvite shows what a link leads to before joining.
+func handlePreviewInvite(c *gin.Context, db *sql.DB) {
+	invite, ok := getUsableInvite(c, db, c.Param("token"))
+	if !ok {
+		return
+	}
+
+	var name string
+	var memberCount int
+	err := db.QueryRow(`
+		SELECT c.Name, (SELECT COUNT(*) FROM ChatMember WHERE ChatID = c.ID)
+		FROM Chat c
+		WHERE c.ID = ?
+	`, invite.ChatID).Scan(&name, &memberCount)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading invite link"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"success":          true,
+		"chatId":           invite.ChatID,
+		"name":             name,
+		"memberCount":      memberCount,
+		"requiresApproval": invite.RequiresApproval,
+	})
+}
+
+// handleJoinByInvite adds the caller to the chat of the link, or files a join
+// request if the link requires approval. Joining a chat the caller is already
+// a member of, or asking twice, doesn't use the link up.
+func handleJoinByInvite(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+
+	invite, ok := getUsableInvite(c, db, c.Param("token"))
+	if !ok {
+		return
+	}
+
+	if _, err := getMemberRole(db, invite.ChatID, userId); err == nil {
+		c.JSON(200, gin.H{"success": true, "chatId": invite.ChatID, "joined": true})
+		return
+	} else if err != sql.ErrNoRows {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error joining chat"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error joining chat"})
+		return
+	}
+	defer tx.Rollback()
+
+	if invite.RequiresApproval {
+		res, err := tx.Exec(`INSERT IGNORE INTO ChatJoinRequest (ChatID, UserID, InviteID) VALUES (?, ?, ?)`, invite.ChatID, userId, invite.ID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error joining chat"})
+			return
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			// already asked
+			c.JSON(202, gin.H{"success": true, "chatId": invite.ChatID, "joined": false})
+			return
+		}
+	} else {
+		res, err := tx.Exec(`INSERT IGNORE INTO ChatMember (ChatID, UserID, Role) VALUES (?, ?, ?)`, invite.ChatID, userId, RoleMember)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error joining chat"})
+			return
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			// joined by a concurrent request
+			c.JSON(200, gin.H{"success": true, "chatId": invite.ChatID, "joined": true})
+			return
+		}
+	}
+
+	// the condition is checked again here so concurrent joins can't exceed MaxUses
+	res, err := tx.Exec(`UPDATE ChatInvite SET Uses = Uses + 1 WHERE ID = ? AND `+inviteUsable, invite.ID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error joining chat"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(404, gin.H{"success": false, "error": "invite link is invalid or expired"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error joining chat"})
+		return
+	}
+
+	if invite.RequiresApproval {
+		c.JSON(202, gin.H{"success": true, "chatId": invite.ChatID, "joined": false})
+		return
+	}
+
+	announceJoin(db, hubs, invite.ChatID, userId, userId, getUserName(db, userId)+" joined via an invite link")
+
+	c.JSON(200, gin.H{"success": true, "chatId": invite.ChatID, "joined": true})
+}
+
+func handleListJoinRequests(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT r.ID, r.ChatID, r.InviteID, r.Created, u.ID, u.FullName, u.Handle, COALESCE(u.AvatarLink, '')
+		FROM ChatJoinRequest r
+		JOIN User u ON u.ID = r.UserID
+		WHERE r.ChatID = ?
+		ORDER BY r.ID
+	`, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting join requests"})
+		return
+	}
+	defer rows.Close()
+
+	requests := []ChatJoinRequest{}
+	for rows.Next() {
+		request := ChatJoinRequest{}
+		err := rows.Scan(&request.ID, &request.ChatID, &request.InviteID, &request.Created, &request.User.ID, &request.User.FullName, &request.User.Handle, &request.User.AvatarLink)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error getting join requests"})
+			return
+		}
+		requests = append(requests, request)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting join requests"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "requests": requests})
+}
+
+func handleApproveJoinRequest(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	requesterId, ok := getIdParam(c, "userId")
+	if !ok {
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error approving join request"})
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM ChatJoinRequest WHERE ChatID = ? AND UserID = ?`, chatID, requesterId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error approving join request"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(404, gin.H{"success": false, "error": "join request not found"})
+		return
+	}
+
+	res, err = tx.Exec(`INSERT IGNORE INTO ChatMember (ChatID, UserID, Role) VALUES (?, ?, ?)`, chatID, requesterId, RoleMember)
+	var joined int64
+	if err == nil {
+		joined, _ = res.RowsAffected()
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error approving join request"})
+		return
+	}
+
+	// someone who became a member meanwhile, e.g. through another link, was
+	// already announced
+	if joined > 0 {
+		announceJoin(db, hubs, chatID, requesterId, userId, getUserName(db, userId)+" approved "+getUserName(db, requesterId)+"'s request to join")
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+func handleDeclineJoinRequest(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	requesterId, ok := getIdParam(c, "userId")
+	if !ok {
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	res, err := db.Exec(`DELETE FROM ChatJoinRequest WHERE ChatID = ? AND UserID = ?`, chatID, requesterId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error declining join request"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(404, gin.H{"success": false, "error": "join request not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Group membership. Every chat has one owner. Admins add members, and so do
+// plain members if the chat's permissions allow it; admins remove plain
+// members; only the owner changes roles, removes admins and hands ownership
+// over. Each change is recorded as a system message and published as a
+// chat.member_* event.
+
+type ChatMemberRemovedPayload struct {
+	UserID int64 `json:"userId"`
+}
+
+func getChatMember(db *sql.DB, chatID, userID int64) (ChatMember, error) {
+	member := ChatMember{}
+	err := db.QueryRow(`
+		SELECT ID, ChatID, UserID, Role, LastDeliveredMessageID, LastReadMessageID
+		FROM ChatMember
+		WHERE ChatID = ? AND UserID = ?
+	`, chatID, userID).Scan(&member.ID, &member.ChatID, &member.UserID, &member.Role, &member.LastDeliveredMessageID, &member.LastReadMessageID)
+
+	return member, err
+}
+
+// getUserName returns the FullName used in system messages.
+func getUserName(db *sql.DB, userID int64) string {
+	var name string
+	if err := db.QueryRow(`SELECT FullName FROM User WHERE ID = ?`, userID).Scan(&name); err != nil {
+		return "someone"
+	}
+
+	return name
+}
+
+// requireManagedChat answers 400 and returns false unless the chat is a
+// group or a channel.
+func requireManagedChat(c *gin.Context, db *sql.DB, chatID int64) bool {
+	chatType, err := getChatType(db, chatID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "chat not found"})
+		return false
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return false
+	}
+	if chatType == ChatTypeDirect {
+		c.JSON(400, gin.H{"success": false, "error": "direct chats have no managed members"})
+		return false
+	}
+
+	return true
+}
+
+func handleAddMembers(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		UserIDs []int64 `json:"userIds"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil || len(reqBody.UserIDs) == 0 {
+		c.JSON(400, gin.H{"success": false, "error": "userIds is required"})
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	if !requirePermission(c, db, chatID, userId, PermissionAddMembers) {
+		return
+	}
+
+	added := []ChatMember{}
+	for _, memberId := range reqBody.UserIDs {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM User WHERE ID = ?)`, memberId).Scan(&exists); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error adding members"})
+			return
+		}
+		if !exists {
+			c.JSON(400, gin.H{"success": false, "error": "unknown member"})
+			return
+		}
+
+		// members that are already in the chat are skipped
+		res, err := db.Exec(`INSERT IGNORE INTO ChatMember (ChatID, UserID, Role) VALUES (?, ?, ?)`, chatID, memberId, RoleMember)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error adding members"})
+			return
+		}
+		if rows, _ := res.RowsAffected(); rows == 0 {
+			continue
+		}
+
+		member, err := announceJoin(db, hubs, chatID, memberId, userId, getUserName(db, userId)+" added "+getUserName(db, memberId))
+		if err != nil {
+			c.JSON(500, gin.H{"success": false, "error": "error adding members"})
+			return
+		}
+		added = append(added, member)
+	}
+
+	c.JSON(200, gin.H{"success": true, "added": added})
+}
+
+func handleRemoveMember(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	targetId, ok := getIdParam(c, "userId")
+	if !ok {
+		return
+	}
+
+	if targetId == userId {
+		c.JSON(400, gin.H{"success": false, "error": "use leave to remove yourself"})
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	role, ok := requireRole(c, db, chatID, userId, RoleOwner, RoleAdmin)
+	if !ok {
+		return
+	}
+
+	target, err := getChatMember(db, chatID, targetId)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "user is not a member of this chat"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error removing member"})
+		return
+	}
+
+	// admins may only remove plain members
+	if target.Role == RoleOwner || (role == RoleAdmin && target.Role != RoleMember) {
+		c.JSON(403, gin.H{"success": false, "error": "your role in this chat doesn't allow this", "code": ErrorCodePermissionDenied})
+		return
+	}
+
+	if !removeMember(c, db, hubs, chatID, targetId, userId, getUserName(db, userId)+" removed "+getUserName(db, targetId)) {
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+func handleLeaveChat(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	role, ok := requireRole(c, db, chatID, userId)
+	if !ok {
+		return
+	}
+	if role == RoleOwner {
+		c.JSON(400, gin.H{"success": false, "error": "the owner has to transfer ownership or delete the chat"})
+		return
+	}
+
+	if !removeMember(c, db, hubs, chatID, userId, userId, getUserName(db, userId)+" left") {
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// removeMember deletes the membership and announces it. On failure it
+// writes the response.
+func removeMember(c *gin.Context, db *sql.DB, hubs *HubManager, chatID, userID, actorID int64, text string) bool {
+	_, err := db.Exec(`DELETE FROM ChatMember WHERE ChatID = ? AND UserID = ?`, chatID, userID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error removing member"})
+		return false
+	}
+
+	announceLeave(db, hubs, chatID, userID, actorID, text)
+
+	return true
+}
+
+// announceJoin subscribes a new member to the chat and tells everyone with an
+// event and a system message. Channels don't announce their subscribers. It
+// returns the new membership.
+func announceJoin(db *sql.DB, hubs *HubManager, chatID, userID, actorID int64, text string) (ChatMember, error) {
+	hubs.join(chatID, []int64{userID})
+
+	member, err := getChatMember(db, chatID, userID)
+	if err != nil {
+		log.Println(err)
+		return member, err
+	}
+	if chatType, _ := getChatType(db, chatID); chatType == ChatTypeChannel && member.Role == RoleMember {
+		return member, nil
+	}
+
+	hubs.publish(chatID, EventChatMemberAdded, member)
+	postSystemMessage(db, hubs, chatID, actorID, text)
+
+	return member, nil
+}
+
+// announceLeave is the counterpart of announceJoin for a member that is gone.
+func announceLeave(db *sql.DB, hubs *HubManager, chatID, userID, actorID int64, text string) {
+	if chatType, _ := getChatType(db, chatID); chatType != ChatTypeChannel {
+		// published before leave so the removed user gets it too
+		hubs.publish(chatID, EventChatMemberRemoved, ChatMemberRemovedPayload{UserID: userID})
+		postSystemMessage(db, hubs, chatID, actorID, text)
+	}
+
+	hubs.leave(chatID, []int64{userID})
+}
+
+func handleSetMemberRole(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	targetId, ok := getIdParam(c, "userId")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Role string `json:"role"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil || (reqBody.Role != RoleAdmin && reqBody.Role != RoleMember) {
+		c.JSON(400, gin.H{"success": false, "error": "role must be admin or member"})
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	if _, ok := requireRole(c, db, chatID, userId, RoleOwner); !ok {
+		return
+	}
+
+	target, err := getChatMember(db, chatID, targetId)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "user is not a member of this chat"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error changing role"})
+		return
+	}
+	if target.Role == RoleOwner {
+		c.JSON(400, gin.H{"success": false, "error": "use transfer to change the owner"})
+		return
+	}
+	if target.Role == reqBody.Role {
+		c.JSON(200, gin.H{"success": true, "member": target})
+		return
+	}
+
+	_, err = db.Exec(`UPDATE ChatMember SET Role = ? WHERE ChatID = ? AND UserID = ?`, reqBody.Role, chatID, targetId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error changing role"})
+		return
+	}
+	target.Role = reqBody.Role
+
+	hubs.publish(chatID, EventChatMemberUpdated, target)
+	text := getUserName(db, userId) + " made " + getUserName(db, targetId) + " an admin"
+	if reqBody.Role == RoleMember {
+		text = getUserName(db, userId) + " removed " + getUserName(db, targetId) + " from the admins"
+	}
+	postSystemMessage(db, hubs, chatID, userId, text)
+
+	c.JSON(200, gin.H{"success": true, "member": target})
+}
+
+func handleTransferOwnership(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		UserID int64 `json:"userId"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil || reqBody.UserID == 0 {
+		c.JSON(400, gin.H{"success": false, "error": "userId is required"})
+		return
+	}
+	if reqBody.UserID == userId {
+		c.JSON(400, gin.H{"success": false, "error": "you already own this chat"})
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	if _, ok := requireRole(c, db, chatID, userId, RoleOwner); !ok {
+		return
+	}
+	if _, err := getMemberRole(db, chatID, reqBody.UserID); err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "user is not a member of this chat"})
+		return
+	} else if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error transferring ownership"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error transferring ownership"})
+		return
+	}
+	defer tx.Rollback()
+
+	// the previous owner stays on as an admin
+	_, err = tx.Exec(`UPDATE ChatMember SET Role = ? WHERE ChatID = ? AND UserID = ?`, RoleAdmin, chatID, userId)
+	if err == nil {
+		_, err = tx.Exec(`UPDATE ChatMember SET Role = ? WHERE ChatID = ? AND UserID = ?`, RoleOwner, chatID, reqBody.UserID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error transferring ownership"})
+		return
+	}
+
+	for _, memberId := range []int64{userId, reqBody.UserID} {
+		member, err := getChatMember(db, chatID, memberId)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		hubs.publish(chatID, EventChatMemberUpdated, member)
+	}
+	postSystemMessage(db, hubs, chatID, userId, getUserName(db, userId)+" transferred ownership to "+getUserName(db, reqBody.UserID))
+
+	c.JSON(200, gin.H{"success": true})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Socket counterparts of POST /message/, PUT /message/:id and
+// DELETE /message/:id. The id of the envelope is the client generated ID;
+// it is echoed on the ack or error frame, and on message.created so the
+// sender's other devices can match their optimistic copy.
+
+type AckPayload struct {
+	MessageID int64  `json:"messageId"`
+	Timestamp string `json:"timestamp,omitempty"`
+}
+
+func init() {
+	registerCommand(CommandMessageSend, handleMessageSendCommand)
+	registerCommand(CommandMessageEdit, handleMessageEditCommand)
+	registerCommand(CommandMessageDelete, handleMessageDeleteCommand)
+}
+
+func handleMessageSendCommand(client *Client, env Envelope) error {
+	message := Message{}
+	if err := json.Unmarshal(env.Payload, &message); err != nil {
+		return newWsError(ErrorCodeBadPayload, "payload must be a message")
+	}
+	message.ChatID = env.ChatID
+	message.UserID = client.id
+	message.ClientID = env.ID
+
+	message, err := saveMessage(client.db, client.hubs, message)
+	if err != nil {
+		return messageWsError(err)
+	}
+
+	return client.sendAck(env.ID, AckPayload{MessageID: message.ID, Timestamp: message.Timestamp})
+}
+
+func handleMessageEditCommand(client *Client, env Envelope) error {
+	var payload struct {
+		MessageID int64  `json:"messageId"`
+		Text      string `json:"text"`
+	}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return newWsError(ErrorCodeBadPayload, "payload must contain messageId and text")
+	}
+
+	message, err := editMessage(client.db, client.hubs, client.id, payload.MessageID, payload.Text)
+	if err != nil {
+		return messageWsError(err)
+	}
+
+	return client.sendAck(env.ID, AckPayload{MessageID: message.ID, Timestamp: message.Timestamp})
+}
+
+func handleMessageDeleteCommand(client *Client, env Envelope) error {
+	var payload struct {
+		MessageID int64  `json:"messageId"`
+		For       string `json:"for"`
+	}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return newWsError(ErrorCodeBadPayload, "payload must contain messageId")
+	}
+	if payload.For == "" {
+		payload.For = DeleteForEveryone
+	}
+	if payload.For != DeleteForEveryone && payload.For != DeleteForMe {
+		return newWsError(ErrorCodeBadPayload, "for must be me or everyone")
+	}
+
+	if err := deleteMessage(client.db, client.hubs, client.id, payload.MessageID, payload.For); err != nil {
+		return messageWsError(err)
+	}
+
+	return client.sendAck(env.ID, AckPayload{MessageID: payload.MessageID})
+}
+
+func (client *Client) sendAck(id string, payload AckPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return client.sendEvent(Envelope{Type: EventAck, ID: id, Payload: data})
+}
+
+// messageWsError turns an error of messages.go into an error frame.
+func messageWsError(err error) error {
+	var invalid *invalidMessageError
+	var denied *permissionError
+	switch {
+	case errors.As(err, &denied):
+		return &wsError{code: ErrorCodePermissionDenied, message: denied.Error(), permission: denied.permission}
+	case errors.As(err, &invalid):
+		return newWsError(ErrorCodeInvalidMessage, invalid.Error())
+	case errors.Is(err, errNotMember):
+		return newWsError(ErrorCodeNotMember, err.Error())
+	case errors.Is(err, errNotAuthor):
+		return newWsError(ErrorCodeNotAuthor, err.Error())
+	case errors.Is(err, errEditWindowExpired), errors.Is(err, errDeleteWindowExpired):
+		return newWsError(ErrorCodeWindowExpired, err.Error())
+	case errors.Is(err, errMessageNotFound):
+		return newWsError(ErrorCodeNotFound, "message not found")
+	}
+
+	return err
+}
@@ -4,160 +4,233 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
-	"sync"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 )
 
-func addMessageRoutes(router *gin.RouterGroup, db *sql.DB) {
+func addMessageRoutes(router *gin.RouterGroup, db *sql.DB, hubs *HubManager) {
 	message := router.Group("/message")
+	message.Use(authMiddleWare)
 	{
 		message.POST("/", func(ctx *gin.Context) {
-			handleSaveMessage(ctx, db)
+			handleSaveMessage(ctx, db, hubs)
 		})
 		message.GET("/", func(c *gin.Context) {
 			handleGetMessages(c, db)
 		})
 		message.PUT("/:id", func(c *gin.Context) {
-			handleEditMessage(c, db)
+			handleEditMessage(c, db, hubs)
 		})
 		message.DELETE("/:id", func(c *gin.Context) {
-			handleDeleteMessage(c, db)
+			handleDeleteMessage(c, db, hubs)
+		})
+		message.GET("/:id/seen", func(c *gin.Context) {
+			handleGetSeenBy(c, db)
+		})
+		message.GET("/:id/views", func(c *gin.Context) {
+			handleGetMessageViews(c, db)
+		})
+		message.GET("/:id/history", func(c *gin.Context) {
+			handleGetMessageHistory(c, db)
+		})
+		message.GET("/:id/thread", func(c *gin.Context) {
+			handleGetThread(c, db)
+		})
+		message.PUT("/:id/thread/follow", func(c *gin.Context) {
+			handleFollowThread(c, db, true)
+		})
+		message.DELETE("/:id/thread/follow", func(c *gin.Context) {
+			handleFollowThread(c, db, false)
 		})
 	}
 }
 
-func handleDeleteMessage(c *gin.Context, db *sql.DB) {
-	id := c.Param("id")
+// handleDeleteMessage deletes a message for everyone, or with ?for=me hides
+// it for the caller only.
+func handleDeleteMessage(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid message id"})
+		return
+	}
+	mode := c.DefaultQuery("for", DeleteForEveryone)
+	if mode != DeleteForEveryone && mode != DeleteForMe {
+		c.JSON(400, gin.H{"success": false, "error": "for must be me or everyone"})
+		return
+	}
 
-	_, err := db.Exec("DELETE FROM Message WHERE ID = ?", id)
+	err = deleteMessage(db, hubs, userId, id, mode)
 	if err != nil {
-		c.JSON(500, gin.H{"success": false, "error": "failed to delete message"})
-		log.Fatal("failed to delete message")
+		writeMessageError(c, err, "failed to delete message")
+		return
 	}
 
 	c.JSON(200, gin.H{"success": true})
 }
 
-func handleSaveMessage(c *gin.Context, db *sql.DB) {
-	message := Message{}
-	err := c.BindJSON(&message)
-	if err != nil {
-		log.Fatal("failed to read message body")
-		c.JSON(500, gin.H{"success": false, "error": "failed to read message body"})
-	}
-
-	tx, err := db.Begin()
-	if err != nil {
-		log.Println(err)
-		c.JSON(500, gin.H{"success": false, "error": "failed to start transaction"})
+func handleSaveMessage(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
 	}
 
-	_, err = tx.Exec("INSERT INTO Message (ChatID, UserID, TextContent) VALUES ? , ? , ?", message.ChatID, message.UserID, message.TextContent)
+	message := Message{}
+	err := c.BindJSON(&message)
 	if err != nil {
 		log.Println(err)
-		tx.Rollback()
-		c.JSON(500, gin.H{"success": false, "error": "failed to save message"})
-	}
-
-	if len(message.Attachaments) > 0 {
-		for _, attachament := range message.Attachaments {
-			_, err = tx.Exec("INSERT INTO Attachament (MessageID, Type, Link) VALUES ? , ? , ?", attachament.MessageID, attachament.Type, attachament.Link)
-			if err != nil {
-				log.Println(err)
-				tx.Rollback()
-				c.JSON(500, gin.H{"success": false, "error": "failed to save attachament"})
-			}
-		}
+		c.JSON(400, gin.H{"success": false, "error": "failed to read message body"})
+		return
 	}
+	// the sender is whoever the token belongs to, never the body
+	message.UserID = userId
 
-	err = tx.Commit()
+	message, err = saveMessage(db, hubs, message)
 	if err != nil {
-		log.Println(err)
-		c.JSON(500, gin.H{"success": false, "error": "failed to commit transaction"})
+		writeMessageError(c, err, "failed to save message")
+		return
 	}
 
-	c.JSON(200, gin.H{"success": true})
+	c.JSON(200, gin.H{"success": true, "message": message})
 }
 
+// handleGetMessages returns a page of the history of a chat, oldest first.
+// Without a cursor it is the latest page. before and after take the
+// prevCursor / nextCursor of a previous page to scroll back or forward;
+// around takes a message ID and returns the page centered on it. Pages are
+// keyed on the message ID, so messages arriving while scrolling neither
+// shift nor repeat them.
 func handleGetMessages(c *gin.Context, db *sql.DB) {
-	params := c.Request.URL.Query()
-	chatID := params["chatID"][0]
-	from := params["from"][0]
-	limit := params["limit"][0]
-
-	rows, err := db.Query("SELECT * FROM Message WHERE ChatID = ? ORDER BY TIMESTAMP DESC LIMIT ? OFFSET ?", chatID, limit, from)
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, err := strconv.ParseInt(c.Query("chatID"), 10, 64)
 	if err != nil {
-		log.Fatal("failed to get messages")
-		c.JSON(500, gin.H{"success": false, "error": "failed to get messages"})
+		c.JSON(400, gin.H{"success": false, "error": "chatID is required"})
+		return
+	}
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	limit := messagePageSize
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > maxMessagePageSize {
+			c.JSON(400, gin.H{"success": false, "error": "limit must be between 1 and " + strconv.Itoa(maxMessagePageSize)})
+			return
+		}
 	}
 
-	messages := []Message{}
-	for rows.Next() {
-		message := Message{}
-		err = rows.Scan(&message.ID, &message.ChatID, &message.UserID, &message.TextContent, &message.Timestamp, &message.ReplyToId, &message.WasEdited)
+	cursors := 0
+	for _, name := range []string{"before", "after", "around"} {
+		if c.Query(name) != "" {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		c.JSON(400, gin.H{"success": false, "error": "only one of before, after and around can be set"})
+		return
+	}
+
+	var page messagePage
+	// the IDs the page was asked for, cursors of an empty page come from them
+	var beforeID, afterID int64
+	switch {
+	case c.Query("before") != "":
+		id, ok := decodeCursor(c, c.Query("before"))
+		if !ok {
+			return
+		}
+		beforeID = id
+		page, err = getMessagesBefore(db, chatID, userId, id, limit)
+	case c.Query("after") != "":
+		id, ok := decodeCursor(c, c.Query("after"))
+		if !ok {
+			return
+		}
+		afterID = id
+		page, err = getMessagesAfter(db, chatID, userId, id, limit)
+	case c.Query("around") != "":
+		var id int64
+		id, err = strconv.ParseInt(c.Query("around"), 10, 64)
 		if err != nil {
-			log.Fatal("failed to read message")
-			c.JSON(500, gin.H{"success": false, "error": "failed to read message"})
+			c.JSON(400, gin.H{"success": false, "error": "invalid around"})
+			return
+		}
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Message WHERE ID = ? AND ChatID = ?)`, id, chatID).Scan(&exists); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "failed to get messages"})
+			return
 		}
-		sem := make(chan struct{}, 4)
-		wg := &sync.WaitGroup{}
-		for _, message := range messages {
-			wg.Add(1)
-			sem <- struct{}{}
-			go func(message *Message) {
-				defer func() {
-					wg.Done()
-					<-sem
-				}()
-				attachments := []Attachament{}
-				attachamentRows, err := db.Query("SELECT * FROM Attachament WHERE MessageID = ?", message.ID)
-				if err != nil {
-					log.Fatal("failed to get attachaments")
-					c.JSON(500, gin.H{"success": false, "error": "failed to get attachaments"})
-				}
-				for attachamentRows.Next() {
-					attachament := Attachament{}
-					err = attachamentRows.Scan(&attachament.ID, &attachament.MessageID, &attachament.Type, &attachament.Link)
-					if err != nil {
-						log.Fatal("failed to read attachament")
-						c.JSON(500, gin.H{"success": false, "error": "failed to read attachament"})
-					}
-					attachments = append(attachments, attachament)
-				}
-				message.Attachaments = attachments
-			}(&message)
+		if !exists {
+			c.JSON(404, gin.H{"success": false, "error": errMessageNotFound.Error()})
+			return
 		}
-		wg.Wait()
-		close(sem)
+		beforeID, afterID = id, id-1
+		page, err = getMessagesAround(db, chatID, userId, id, limit)
+	default:
+		page, err = getMessagesBefore(db, chatID, userId, 0, limit)
+	}
+	if err != nil {
+		log.Printf("error getting messages of chat %d: %s", chatID, err.Error())
+		c.JSON(500, gin.H{"success": false, "error": "failed to get messages"})
+		return
 	}
 
-	c.JSON(200, gin.H{"success": true, "messages": messages})
+	if err := addMessageDetails(db, page.messages); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get messages"})
+		return
+	}
+
+	response := gin.H{
+		"success":       true,
+		"messages":      page.messages,
+		"hasMoreBefore": page.hasMoreBefore,
+		"hasMoreAfter":  page.hasMoreAfter,
+	}
+	prevCursor, nextCursor := pageCursors(page, beforeID, afterID)
+	if prevCursor != "" {
+		response["prevCursor"] = prevCursor
+	}
+	if nextCursor != "" {
+		response["nextCursor"] = nextCursor
+	}
+	c.JSON(200, response)
 }
 
-func handleEditMessage(c *gin.Context, db *sql.DB) {
-	// Get message ID and new message text from request body
+func handleEditMessage(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message id"})
+		return
+	}
+
+	// Get the new message text from request body
 	var reqBody struct {
-		MessageID int    `json:"message_id"`
-		Text      string `json:"text"`
+		Text string `json:"text"`
 	}
 	if err := c.BindJSON(&reqBody); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
-	// Update message in database
-	stmt, err := db.Prepare("UPDATE messages SET TextContent = ? WHERE ID = ?")
+	message, err := editMessage(db, hubs, userId, id, reqBody.Text)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare statement"})
-		return
-	}
-	defer stmt.Close()
-
-	if _, err := stmt.Exec(reqBody.Text, reqBody.MessageID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update message"})
+		writeMessageError(c, err, "Failed to update message")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message updated successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Message updated successfully", "data": message})
 }
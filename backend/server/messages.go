@@ -0,0 +1,411 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Persistence of messages, shared by the REST handlers in message_routes.go
+// and the socket commands in message_commands.go so both behave the same.
+
+const maxTextLength = 10000
+
+// invalidMessageError is returned when a message is refused before anything
+// is stored. Its text is safe to show to the client.
+type invalidMessageError struct {
+	reason string
+}
+
+func (e *invalidMessageError) Error() string {
+	return e.reason
+}
+
+func validateMessage(db *sql.DB, message Message) error {
+	if message.ChatID == 0 {
+		return &invalidMessageError{"chatId is required"}
+	}
+
+	if strings.TrimSpace(message.TextContent) == "" && len(message.Attachaments) == 0 {
+		return &invalidMessageError{"message has no content"}
+	}
+
+	if len(message.TextContent) > maxTextLength {
+		return &invalidMessageError{"message is too long"}
+	}
+
+	for _, attachament := range message.Attachaments {
+		if attachament.Type == "" || attachament.Link == "" {
+			return &invalidMessageError{"attachaments need a type and a link"}
+		}
+	}
+
+	permissions, err := getMemberPermissions(db, message.ChatID, message.UserID)
+	if err != nil {
+		return err
+	}
+	if !permissions[PermissionSendMessages] {
+		return &permissionError{PermissionSendMessages}
+	}
+	if len(message.Attachaments) > 0 && !permissions[PermissionSendMedia] {
+		return &permissionError{PermissionSendMedia}
+	}
+
+	if message.ReplyToId != 0 {
+		var exists bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Message WHERE ID = ? AND ChatID = ?)`, message.ReplyToId, message.ChatID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return &invalidMessageError{"replied message is not in this chat"}
+		}
+	}
+
+	return nil
+}
+
+// saveMessage validates and stores a new message with its attachaments and
+// publishes message.created. The returned message has its ID and Timestamp set.
+func saveMessage(db *sql.DB, hubs *HubManager, message Message) (Message, error) {
+	// the sender only picks the content, the reply and the client ID; the
+	// rest is filled in here, and only postSystemMessage writes system messages
+	message = Message{
+		ChatID:       message.ChatID,
+		UserID:       message.UserID,
+		TextContent:  message.TextContent,
+		Attachaments: newAttachaments(message.Attachaments),
+		ReplyToId:    message.ReplyToId,
+		ClientID:     message.ClientID,
+	}
+	if err := validateMessage(db, message); err != nil {
+		return message, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return message, err
+	}
+	defer tx.Rollback()
+
+	var replyTo, threadID interface{}
+	if message.ReplyToId != 0 {
+		previews, err := getReplyPreviews(db, []int64{message.ReplyToId})
+		if err != nil {
+			return message, err
+		}
+		preview := previews[message.ReplyToId]
+		message.ReplyPreview = &preview
+		message.ThreadID = preview.threadID
+		replyTo, threadID = message.ReplyToId, message.ThreadID
+	}
+
+	res, err := tx.Exec("INSERT INTO Message (ChatID, UserID, TextContent, ReplyToId, ThreadID) VALUES (?, ?, ?, ?, ?)", message.ChatID, message.UserID, message.TextContent, replyTo, threadID)
+	if err != nil {
+		return message, err
+	}
+
+	message.ID, err = res.LastInsertId()
+	if err != nil {
+		return message, err
+	}
+
+	for i := range message.Attachaments {
+		message.Attachaments[i].MessageID = message.ID
+		attachament := message.Attachaments[i]
+		res, err = tx.Exec("INSERT INTO Attachament (MessageID, Type, Link) VALUES (?, ?, ?)", attachament.MessageID, attachament.Type, attachament.Link)
+		if err != nil {
+			return message, err
+		}
+		message.Attachaments[i].ID, err = res.LastInsertId()
+		if err != nil {
+			return message, err
+		}
+	}
+
+	err = tx.QueryRow("SELECT Timestamp FROM Message WHERE ID = ?", message.ID).Scan(&message.Timestamp)
+	if err != nil {
+		return message, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return message, err
+	}
+
+	if message.ThreadID != 0 {
+		followThread(db, message.ThreadID, message.UserID)
+	}
+
+	// push the new message to everyone of the chat who is connected right now
+	hubs.publish(message.ChatID, EventMessageCreated, message)
+	// one event per member, which in a large channel is too many to wait for
+	go notifyMembers(db, hubs, message)
+
+	return message, nil
+}
+
+// newAttachaments copies the type and link of attachaments sent by a client,
+// their IDs are assigned when they are stored.
+func newAttachaments(sent []Attachament) []Attachament {
+	attachaments := []Attachament{}
+	for _, attachament := range sent {
+		attachaments = append(attachaments, Attachament{Type: attachament.Type, Link: attachament.Link})
+	}
+
+	return attachaments
+}
+
+// postSystemMessage stores a message written by the server on behalf of
+// actorID, e.g. to record a membership change, and publishes message.created.
+// Unlike saveMessage it doesn't require the actor to still be a member.
+func postSystemMessage(db *sql.DB, hubs *HubManager, chatID, actorID int64, text string) {
+	res, err := db.Exec("INSERT INTO Message (ChatID, UserID, TextContent, IsSystem) VALUES (?, ?, ?, TRUE)", chatID, actorID, text)
+	if err != nil {
+		log.Printf("error saving system message in chat %d: %s", chatID, err.Error())
+		return
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Printf("error saving system message in chat %d: %s", chatID, err.Error())
+		return
+	}
+
+	message, err := getMessage(db, id)
+	if err != nil {
+		log.Printf("error reading system message %d: %s", id, err.Error())
+		return
+	}
+
+	hubs.publish(chatID, EventMessageCreated, message)
+}
+
+var errNotAuthor = errors.New("only the author or an admin of the chat can change this message")
+
+// authorizeMessageChange returns nil if the actor wrote the message or is an
+// owner or admin of its chat, errNotMember or errNotAuthor otherwise.
+func authorizeMessageChange(db *sql.DB, actorID int64, message Message) error {
+	role, err := getMemberRole(db, message.ChatID, actorID)
+	if err == sql.ErrNoRows {
+		return errNotMember
+	}
+	if err != nil {
+		return err
+	}
+
+	if message.UserID == actorID || role == RoleOwner || role == RoleAdmin {
+		return nil
+	}
+
+	return errNotAuthor
+}
+
+// editMessage replaces the text of a message on behalf of actorID, keeps the
+// previous text as a revision and publishes message.edited.
+func editMessage(db *sql.DB, hubs *HubManager, actorID, messageID int64, text string) (Message, error) {
+	message, err := getMessage(db, messageID)
+	if err == sql.ErrNoRows {
+		return message, errMessageNotFound
+	}
+	if err != nil {
+		return message, err
+	}
+	if err := authorizeMessageChange(db, actorID, message); err != nil {
+		return message, err
+	}
+
+	if message.IsSystem {
+		return message, &invalidMessageError{"system messages can't be edited"}
+	}
+	if message.DeletedAt != nil {
+		return message, &invalidMessageError{"deleted messages can't be edited"}
+	}
+	if err := checkPermission(db, message.ChatID, actorID, PermissionSendMessages); err != nil {
+		return message, err
+	}
+	if strings.TrimSpace(text) == "" && len(message.Attachaments) == 0 {
+		return message, &invalidMessageError{"message has no content"}
+	}
+	if len(text) > maxTextLength {
+		return message, &invalidMessageError{"message is too long"}
+	}
+	if err := checkEditWindow(db, messageID); err != nil {
+		return message, err
+	}
+	if text == message.TextContent {
+		return message, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return message, err
+	}
+	defer tx.Rollback()
+
+	if err := saveRevision(tx, message, actorID, text); err != nil {
+		return message, err
+	}
+	_, err = tx.Exec("UPDATE Message SET TextContent = ?, WasEdited = TRUE, EditedAt = NOW() WHERE ID = ?", text, messageID)
+	if err != nil {
+		return message, err
+	}
+	var editedAt string
+	if err := tx.QueryRow("SELECT EditedAt FROM Message WHERE ID = ?", messageID).Scan(&editedAt); err != nil {
+		return message, err
+	}
+	if err := tx.Commit(); err != nil {
+		return message, err
+	}
+
+	message.TextContent = text
+	message.WasEdited = true
+	message.EditedAt = &editedAt
+	hubs.publish(message.ChatID, EventMessageEdited, message)
+
+	return message, nil
+}
+
+// messageColumns lists the Message columns in the order scanMessage reads them.
+const messageColumns = `ID, ChatID, UserID, COALESCE(TextContent, ''), Timestamp, WasEdited, EditedAt, DeletedAt, COALESCE(ReplyToId, 0), COALESCE(ThreadID, 0), IsSystem`
+
+func scanMessage(row interface{ Scan(...interface{}) error }, message *Message) error {
+	var editedAt, deletedAt sql.NullString
+	err := row.Scan(&message.ID, &message.ChatID, &message.UserID, &message.TextContent, &message.Timestamp, &message.WasEdited, &editedAt, &deletedAt, &message.ReplyToId, &message.ThreadID, &message.IsSystem)
+	if err != nil {
+		return err
+	}
+
+	message.EditedAt = nil
+	if editedAt.Valid {
+		message.EditedAt = &editedAt.String
+	}
+	message.DeletedAt = nil
+	if deletedAt.Valid {
+		message.DeletedAt = &deletedAt.String
+	}
+
+	return nil
+}
+
+// getMessage loads a single message with its attachaments.
+func getMessage(db *sql.DB, id int64) (Message, error) {
+	message := Message{}
+	err := scanMessage(db.QueryRow(`SELECT `+messageColumns+` FROM Message WHERE ID = ?`, id), &message)
+	if err != nil {
+		return message, err
+	}
+
+	message.Attachaments = []Attachament{}
+	if message.DeletedAt != nil {
+		// the attachaments of tombstones may not be cleaned up yet
+		return message, nil
+	}
+
+	rows, err := db.Query("SELECT ID, MessageID, Type, Link FROM Attachament WHERE MessageID = ?", id)
+	if err != nil {
+		return message, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachament := Attachament{}
+		err = rows.Scan(&attachament.ID, &attachament.MessageID, &attachament.Type, &attachament.Link)
+		if err != nil {
+			return message, err
+		}
+		message.Attachaments = append(message.Attachaments, attachament)
+	}
+
+	return message, rows.Err()
+}
+
+// getMessages loads many messages with their attachaments, keyed by ID.
+func getMessages(db *sql.DB, ids []int64) (map[int64]Message, error) {
+	messages := make(map[int64]Message)
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	rows, err := db.Query(`SELECT `+messageColumns+` FROM Message WHERE ID IN (`+placeholders(len(ids))+`)`, int64Args(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		message := Message{}
+		if err := scanMessage(rows, &message); err != nil {
+			return nil, err
+		}
+		messages[message.ID] = message
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	attachaments, err := getAttachaments(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	for id, message := range messages {
+		message.Attachaments = attachaments[id]
+		if message.Attachaments == nil {
+			message.Attachaments = []Attachament{}
+		}
+		messages[id] = message
+	}
+
+	return messages, nil
+}
+
+// getAttachaments loads the attachaments of many messages with one query,
+// keyed by message ID.
+func getAttachaments(db *sql.DB, messageIDs []int64) (map[int64][]Attachament, error) {
+	attachaments := make(map[int64][]Attachament)
+	if len(messageIDs) == 0 {
+		return attachaments, nil
+	}
+
+	rows, err := db.Query("SELECT ID, MessageID, Type, Link FROM Attachament WHERE MessageID IN ("+placeholders(len(messageIDs))+") ORDER BY ID", int64Args(messageIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		attachament := Attachament{}
+		if err := rows.Scan(&attachament.ID, &attachament.MessageID, &attachament.Type, &attachament.Link); err != nil {
+			return nil, err
+		}
+		attachaments[attachament.MessageID] = append(attachaments[attachament.MessageID], attachament)
+	}
+
+	return attachaments, rows.Err()
+}
+
+// writeMessageError answers with the status and message matching an error of
+// the functions above. Unexpected errors are logged and answered with fallback.
+func writeMessageError(c *gin.Context, err error, fallback string) {
+	var invalid *invalidMessageError
+	var denied *permissionError
+	switch {
+	case errors.As(err, &invalid):
+		c.JSON(400, gin.H{"success": false, "error": invalid.Error(), "code": ErrorCodeInvalidMessage})
+	case errors.As(err, &denied):
+		permissionDenied(c, denied)
+	case errors.Is(err, errNotMember):
+		c.JSON(403, gin.H{"success": false, "error": err.Error(), "code": ErrorCodeNotMember})
+	case errors.Is(err, errNotAuthor):
+		c.JSON(403, gin.H{"success": false, "error": err.Error(), "code": ErrorCodeNotAuthor})
+	case errors.Is(err, errEditWindowExpired), errors.Is(err, errDeleteWindowExpired):
+		c.JSON(403, gin.H{"success": false, "error": err.Error(), "code": ErrorCodeWindowExpired})
+	case errors.Is(err, errMessageNotFound):
+		c.JSON(404, gin.H{"success": false, "error": "message not found", "code": ErrorCodeNotFound})
+	default:
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": fallback, "code": ErrorCodeInternal})
+	}
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What plain members of a group may do is set per chat by the owner, and
+// admins can override single permissions for single members, e.g. to stop
+// one user from sending media. Owners and admins may always do everything,
+// both members of a direct chat too, and channel subscribers nothing.
+// Handlers refuse with 403, code permission_denied and the name of the
+// missing permission.
+
+const (
+	PermissionSendMessages = "sendMessages"
+	PermissionSendMedia    = "sendMedia"
+	PermissionAddMembers   = "addMembers"
+	PermissionPinMessages  = "pinMessages"
+	PermissionChangeInfo   = "changeInfo"
+)
+
+// permissionColumns maps every permission to its Chat column holding the
+// default for plain members.
+var permissionColumns = map[string]string{
+	PermissionSendMessages: "CanSendMessages",
+	PermissionSendMedia:    "CanSendMedia",
+	PermissionAddMembers:   "CanAddMembers",
+	PermissionPinMessages:  "CanPinMessages",
+	PermissionChangeInfo:   "CanChangeInfo",
+}
+
+// permissionNames lists the permissions in a fixed order.
+var permissionNames = []string{PermissionSendMessages, PermissionSendMedia, PermissionAddMembers, PermissionPinMessages, PermissionChangeInfo}
+
+type permissionError struct {
+	permission string
+}
+
+func (e *permissionError) Error() string {
+	return "missing permission " + e.permission
+}
+
+// permissionDenied answers 403 for a permissionError.
+func permissionDenied(c *gin.Context, err *permissionError) {
+	c.JSON(403, gin.H{"success": false, "error": err.Error(), "code": ErrorCodePermissionDenied, "permission": err.permission})
+}
+
+// getChatPermissions returns the defaults of a chat for plain members.
+func getChatPermissions(db *sql.DB, chatID int64) (map[string]bool, error) {
+	columns := make([]string, len(permissionNames))
+	values := make([]bool, len(permissionNames))
+	dest := make([]interface{}, len(permissionNames))
+	for i, name := range permissionNames {
+		columns[i] = permissionColumns[name]
+		dest[i] = &values[i]
+	}
+
+	err := db.QueryRow(`SELECT `+strings.Join(columns, ", ")+` FROM Chat WHERE ID = ?`, chatID).Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make(map[string]bool, len(permissionNames))
+	for i, name := range permissionNames {
+		permissions[name] = values[i]
+	}
+
+	return permissions, nil
+}
+
+// getPermissionOverrides returns the permissions set for one member.
+func getPermissionOverrides(db *sql.DB, chatID, userID int64) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT Permission, Allowed FROM ChatMemberPermission WHERE ChatID = ? AND UserID = ?`, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]bool)
+	for rows.Next() {
+		var permission string
+		var allowed bool
+		if err := rows.Scan(&permission, &allowed); err != nil {
+			return nil, err
+		}
+		overrides[permission] = allowed
+	}
+
+	return overrides, rows.Err()
+}
+
+// getMemberPermissions returns what the user may do in the chat, or
+// errNotMember.
+func getMemberPermissions(db *sql.DB, chatID, userID int64) (map[string]bool, error) {
+	var role, chatType string
+	err := db.QueryRow(`
+		SELECT cm.Role, c.ChatType
+		FROM ChatMember cm
+		JOIN Chat c ON c.ID = cm.ChatID
+		WHERE cm.ChatID = ? AND cm.UserID = ?
+	`, chatID, userID).Scan(&role, &chatType)
+	if err == sql.ErrNoRows {
+		return nil, errNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make(map[string]bool, len(permissionNames))
+	if role == RoleOwner || role == RoleAdmin || chatType == ChatTypeDirect {
+		for _, name := range permissionNames {
+			permissions[name] = true
+		}
+		return permissions, nil
+	}
+	if chatType == ChatTypeChannel {
+		for _, name := range permissionNames {
+			permissions[name] = false
+		}
+		return permissions, nil
+	}
+
+	permissions, err = getChatPermissions(db, chatID)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := getPermissionOverrides(db, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+	for name, allowed := range overrides {
+		permissions[name] = allowed
+	}
+
+	return permissions, nil
+}
+
+// checkPermission returns nil if the user may do what the permission
+// covers, errNotMember or a *permissionError if not.
+func checkPermission(db *sql.DB, chatID, userID int64, permission string) error {
+	permissions, err := getMemberPermissions(db, chatID, userID)
+	if err != nil {
+		return err
+	}
+	if !permissions[permission] {
+		return &permissionError{permission}
+	}
+
+	return nil
+}
+
+// requirePermission is checkPermission for handlers. On failure it writes
+// the response and returns false.
+func requirePermission(c *gin.Context, db *sql.DB, chatID, userID int64, permission string) bool {
+	err := checkPermission(db, chatID, userID, permission)
+	var denied *permissionError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &denied):
+		permissionDenied(c, denied)
+	case errors.Is(err, errNotMember):
+		c.JSON(403, gin.H{"success": false, "error": errNotMember.Error(), "code": ErrorCodeNotMember})
+	default:
+		log.Printf("error checking permissions in chat %d: %s", chatID, err.Error())
+		c.JSON(500, gin.H{"success": false, "error": "error checking permissions"})
+	}
+
+	return false
+}
+
+// readPermissions reads a body like {"sendMedia": false}. Unknown names are
+// refused; a null value is kept as nil.
+func readPermissions(c *gin.Context) (map[string]*bool, bool) {
+	var reqBody map[string]*bool
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return nil, false
+	}
+	for name := range reqBody {
+		if _, ok := permissionColumns[name]; !ok {
+			c.JSON(400, gin.H{"success": false, "error": "unknown permission " + name})
+			return nil, false
+		}
+	}
+
+	return reqBody, true
+}
+
+func handleGetChatPermissions(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	permissions, err := getChatPermissions(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting permissions"})
+		return
+	}
+	own, err := getMemberPermissions(db, chatID, userId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting permissions"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "permissions": permissions, "own": own})
+}
+
+// handleUpdateChatPermissions changes the defaults of a group, only the
+// owner may. Members learn about it through chat.updated.
+func handleUpdateChatPermissions(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	update, ok := readPermissions(c)
+	if !ok {
+		return
+	}
+
+	chatType, err := getChatType(db, chatID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "chat not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error updating permissions"})
+		return
+	}
+	if chatType != ChatTypeGroup {
+		c.JSON(400, gin.H{"success": false, "error": "only groups have configurable permissions"})
+		return
+	}
+	if _, ok := requireRole(c, db, chatID, userId, RoleOwner); !ok {
+		return
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	for _, name := range permissionNames {
+		if allowed := update[name]; allowed != nil {
+			sets = append(sets, permissionColumns[name]+" = ?")
+			args = append(args, *allowed)
+		}
+	}
+	if len(sets) > 0 {
+		_, err = db.Exec(`UPDATE Chat SET `+strings.Join(sets, ", ")+` WHERE ID = ?`, append(args, chatID)...)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error updating permissions"})
+			return
+		}
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return
+	}
+	if len(sets) > 0 {
+		hubs.publish(chatID, EventChatUpdated, chat)
+	}
+
+	c.JSON(200, gin.H{"success": true, "permissions": chat.Permissions})
+}
+
+func handleGetMemberPermissions(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	targetId, ok := getIdParam(c, "userId")
+	if !ok {
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	permissions, err := getMemberPermissions(db, chatID, targetId)
+	if errors.Is(err, errNotMember) {
+		c.JSON(404, gin.H{"success": false, "error": "user is not a member of this chat"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting permissions"})
+		return
+	}
+	overrides, err := getPermissionOverrides(db, chatID, targetId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting permissions"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "permissions": permissions, "overrides": overrides})
+}
+
+// handleUpdateMemberPermissions overrides permissions of one plain member. A
+// null value removes the override so the chat's default applies again.
+func handleUpdateMemberPermissions(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	targetId, ok := getIdParam(c, "userId")
+	if !ok {
+		return
+	}
+
+	update, ok := readPermissions(c)
+	if !ok {
+		return
+	}
+
+	if !requireManagedChat(c, db, chatID) {
+		return
+	}
+	if _, ok := requireRole(c, db, chatID, userId, RoleOwner, RoleAdmin); !ok {
+		return
+	}
+
+	target, err := getChatMember(db, chatID, targetId)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "user is not a member of this chat"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error updating permissions"})
+		return
+	}
+	if target.Role != RoleMember {
+		c.JSON(400, gin.H{"success": false, "error": "owners and admins have every permission"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error updating permissions"})
+		return
+	}
+	defer tx.Rollback()
+
+	for name, allowed := range update {
+		if allowed == nil {
+			_, err = tx.Exec(`DELETE FROM ChatMemberPermission WHERE ChatID = ? AND UserID = ? AND Permission = ?`, chatID, targetId, name)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO ChatMemberPermission (ChatID, UserID, Permission, Allowed) VALUES (?, ?, ?, ?)
+				ON DUPLICATE KEY UPDATE Allowed = VALUES(Allowed)
+			`, chatID, targetId, name, *allowed)
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error updating permissions"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error updating permissions"})
+		return
+	}
+
+	target.Permissions, err = getPermissionOverrides(db, chatID, targetId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting permissions"})
+		return
+	}
+	if len(update) > 0 {
+		hubs.publish(chatID, EventChatMemberUpdated, target)
+	}
+
+	c.JSON(200, gin.H{"success": true, "member": target})
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pinned messages of a chat. Pinning needs the pinMessages permission, so
+// owners and admins pin, either member of a direct chat, and plain members
+// of a group if its permissions allow.
+
+type MessageUnpinnedPayload struct {
+	MessageID int64 `json:"messageId"`
+}
+
+func handlePinMessage(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		MessageID int64 `json:"messageId"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil || reqBody.MessageID == 0 {
+		c.JSON(400, gin.H{"success": false, "error": "messageId is required"})
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionPinMessages) {
+		return
+	}
+
+	var isSystem, deleted bool
+	err := db.QueryRow(`SELECT IsSystem, DeletedAt IS NOT NULL FROM Message WHERE ID = ? AND ChatID = ?`, reqBody.MessageID, chatID).Scan(&isSystem, &deleted)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": errMessageNotFound.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error pinning message"})
+		return
+	}
+	if isSystem {
+		c.JSON(400, gin.H{"success": false, "error": "system messages can't be pinned"})
+		return
+	}
+	if deleted {
+		c.JSON(400, gin.H{"success": false, "error": "deleted messages can't be pinned"})
+		return
+	}
+
+	res, err := db.Exec(`INSERT IGNORE INTO PinnedMessage (ChatID, MessageID, PinnedBy) VALUES (?, ?, ?)`, chatID, reqBody.MessageID, userId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error pinning message"})
+		return
+	}
+	pinned, _ := res.RowsAffected()
+
+	pin := PinnedMessage{}
+	err = db.QueryRow(`
+		SELECT MessageID, PinnedBy, Created FROM PinnedMessage WHERE ChatID = ? AND MessageID = ?
+	`, chatID, reqBody.MessageID).Scan(&pin.MessageID, &pin.PinnedBy, &pin.PinnedAt)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error pinning message"})
+		return
+	}
+
+	// pinning a message twice changes nothing and announces nothing
+	if pinned > 0 {
+		hubs.publish(chatID, EventMessagePinned, pin)
+		postSystemMessage(db, hubs, chatID, userId, getUserName(db, userId)+" pinned a message")
+	}
+
+	c.JSON(200, gin.H{"success": true, "pin": pin})
+}
+
+func handleUnpinMessage(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+	messageID, ok := getIdParam(c, "messageId")
+	if !ok {
+		return
+	}
+
+	if !requirePermission(c, db, chatID, userId, PermissionPinMessages) {
+		return
+	}
+
+	res, err := db.Exec(`DELETE FROM PinnedMessage WHERE ChatID = ? AND MessageID = ?`, chatID, messageID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error unpinning message"})
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		c.JSON(404, gin.H{"success": false, "error": "message is not pinned"})
+		return
+	}
+
+	hubs.publish(chatID, EventMessageUnpinned, MessageUnpinnedPayload{MessageID: messageID})
+	postSystemMessage(db, hubs, chatID, userId, getUserName(db, userId)+" unpinned a message")
+
+	c.JSON(200, gin.H{"success": true})
+}
+
+// handleListPins returns the pinned messages of a chat, the most recently
+// pinned first.
+func handleListPins(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	pins, err := getPins(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting pinned messages"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "pins": pins})
+}
+
+func getPins(db *sql.DB, chatID int64) ([]PinnedMessage, error) {
+	rows, err := db.Query(`
+		SELECT MessageID, PinnedBy, Created FROM PinnedMessage WHERE ChatID = ? ORDER BY ID DESC
+	`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := []PinnedMessage{}
+	messageIDs := []int64{}
+	for rows.Next() {
+		pin := PinnedMessage{}
+		if err := rows.Scan(&pin.MessageID, &pin.PinnedBy, &pin.PinnedAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+		messageIDs = append(messageIDs, pin.MessageID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages, err := getMessages(db, messageIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pins {
+		if message, ok := messages[pins[i].MessageID]; ok {
+			pins[i].Message = &message
+		}
+	}
+
+	return pins, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+)
+
+type PresencePayload struct {
+	UserID   int64   `json:"userId"`
+	Online   bool    `json:"online"`
+	LastSeen *string `json:"lastSeen,omitempty"`
+}
+
+// userOnline is called when a user opens their first connection.
+func userOnline(db *sql.DB, hubs *HubManager, userID int64) {
+	publishPresence(db, hubs, PresencePayload{UserID: userID, Online: true})
+}
+
+// userOffline is called when the last connection of a user is closed. It
+// stores the last seen time and tells the users sharing a chat.
+func userOffline(db *sql.DB, hubs *HubManager, userID int64) {
+	_, err := db.Exec(`UPDATE User SET LastSeen = NOW() WHERE ID = ?`, userID)
+	if err != nil {
+		log.Printf("error saving last seen of user %d: %s", userID, err.Error())
+		return
+	}
+
+	var lastSeen string
+	err = db.QueryRow(`SELECT LastSeen FROM User WHERE ID = ?`, userID).Scan(&lastSeen)
+	if err != nil {
+		log.Printf("error reading last seen of user %d: %s", userID, err.Error())
+		return
+	}
+
+	publishPresence(db, hubs, PresencePayload{UserID: userID, Online: false, LastSeen: &lastSeen})
+}
+
+// publishPresence sends a presence.changed event to every connected user who
+// shares a chat with the user, once per recipient no matter how many chats
+// they share. Channels don't count, their subscribers don't know each other.
+// Nothing is sent if the user hides their presence.
+func publishPresence(db *sql.DB, hubs *HubManager, presence PresencePayload) {
+	var privacy string
+	err := db.QueryRow(`SELECT LastSeenPrivacy FROM User WHERE ID = ?`, presence.UserID).Scan(&privacy)
+	if err != nil {
+		log.Printf("error reading presence privacy of user %d: %s", presence.UserID, err.Error())
+		return
+	}
+	if privacy == LastSeenNobody {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT DISTINCT b.UserID FROM ChatMember a
+		JOIN ChatMember b ON b.ChatID = a.ChatID
+		JOIN Chat c ON c.ID = a.ChatID
+		WHERE a.UserID = ? AND b.UserID != ? AND c.ChatType <> ?
+	`, presence.UserID, presence.UserID, ChatTypeChannel)
+	if err != nil {
+		log.Printf("error getting contacts of user %d: %s", presence.UserID, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	data, err := newEvent(EventPresenceChanged, 0, presence)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for rows.Next() {
+		var contactID int64
+		if err := rows.Scan(&contactID); err != nil {
+			log.Println(err)
+			return
+		}
+		hubs.sendToUser(contactID, data)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Receipts are kept as a watermark per ChatMember: every message of the chat
+// up to LastDeliveredMessageID / LastReadMessageID counts as delivered / read.
+// Watermarks only ever move forward.
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+var errMessageNotFound = errors.New("message not found in this chat")
+
+type ReceiptPayload struct {
+	UserID    int64 `json:"userId"`
+	MessageID int64 `json:"messageId"`
+}
+
+func init() {
+	registerCommand(CommandChatDelivered, handleMarkChatCommand)
+	registerCommand(CommandChatRead, handleMarkChatCommand)
+}
+
+// markChat moves the delivered or read watermark of the user up to messageID
+// and tells the chat about it. Reading a message also delivers it. Channels
+// count views instead of publishing receipts to every subscriber.
+func markChat(db *sql.DB, hubs *HubManager, chatID, userID, messageID int64, receipt string) error {
+	var chatType string
+	var lastRead int64
+	err := db.QueryRow(`
+		SELECT c.ChatType, cm.LastReadMessageID
+		FROM ChatMember cm
+		JOIN Chat c ON c.ID = cm.ChatID
+		WHERE cm.ChatID = ? AND cm.UserID = ?
+	`, chatID, userID).Scan(&chatType, &lastRead)
+	if err == sql.ErrNoRows {
+		return errNotMember
+	}
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM Message WHERE ID = ? AND ChatID = ?)`, messageID, chatID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errMessageNotFound
+	}
+
+	if receipt == ReceiptRead {
+		_, err = db.Exec(`
+			UPDATE ChatMember
+			SET LastReadMessageID = GREATEST(LastReadMessageID, ?),
+				LastDeliveredMessageID = GREATEST(LastDeliveredMessageID, ?)
+			WHERE ChatID = ? AND UserID = ?
+		`, messageID, messageID, chatID, userID)
+	} else {
+		_, err = db.Exec(`
+			UPDATE ChatMember
+			SET LastDeliveredMessageID = GREATEST(LastDeliveredMessageID, ?)
+			WHERE ChatID = ? AND UserID = ?
+		`, messageID, chatID, userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if chatType == ChatTypeChannel {
+		if receipt == ReceiptRead && messageID > lastRead {
+			return recordViews(db, chatID, userID, lastRead, messageID)
+		}
+		return nil
+	}
+
+	eventType := EventReceiptDelivered
+	if receipt == ReceiptRead {
+		eventType = EventReceiptRead
+	}
+	hubs.publish(chatID, eventType, ReceiptPayload{UserID: userID, MessageID: messageID})
+
+	return nil
+}
+
+func handleMarkChat(c *gin.Context, db *sql.DB, hubs *HubManager, receipt string) {
+	userId, err := strconv.ParseInt(c.GetString("userId"), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"success": false, "error": "invalid token"})
+		return
+	}
+
+	chatID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid chat id"})
+		return
+	}
+
+	var reqBody struct {
+		MessageID int64 `json:"messageId"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+
+	err = markChat(db, hubs, chatID, userId, reqBody.MessageID, receipt)
+	switch {
+	case errors.Is(err, errNotMember):
+		c.JSON(403, gin.H{"success": false, "error": err.Error(), "code": ErrorCodeNotMember})
+	case errors.Is(err, errMessageNotFound):
+		c.JSON(404, gin.H{"success": false, "error": err.Error()})
+	case err != nil:
+		log.Printf("error marking chat %d as %s: %s", chatID, receipt, err.Error())
+		c.JSON(500, gin.H{"success": false, "error": "failed to update receipt"})
+	default:
+		c.JSON(200, gin.H{"success": true})
+	}
+}
+
+func handleMarkChatCommand(client *Client, env Envelope) error {
+	var payload struct {
+		MessageID int64 `json:"messageId"`
+	}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return newWsError(ErrorCodeBadPayload, "payload must contain messageId")
+	}
+
+	receipt := ReceiptDelivered
+	if env.Type == CommandChatRead {
+		receipt = ReceiptRead
+	}
+
+	err := markChat(client.db, client.hubs, env.ChatID, client.id, payload.MessageID, receipt)
+	switch {
+	case errors.Is(err, errNotMember):
+		return newWsError(ErrorCodeNotMember, err.Error())
+	case errors.Is(err, errMessageNotFound):
+		return newWsError(ErrorCodeNotFound, err.Error())
+	}
+
+	return err
+}
+
+// handleGetSeenBy lists the members who have read the message, and the ones
+// it was only delivered to. The author isn't included. In channels only the
+// owner and admins may ask, since it would reveal the subscribers.
+func handleGetSeenBy(c *gin.Context, db *sql.DB) {
+	userId, err := strconv.ParseInt(c.GetString("userId"), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"success": false, "error": "invalid token"})
+		return
+	}
+
+	var chatID, authorID int64
+	err = db.QueryRow(`SELECT ChatID, UserID FROM Message WHERE ID = ?`, c.Param("id")).Scan(&chatID, &authorID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "message not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get receipts"})
+		return
+	}
+
+	role, ok := requireRole(c, db, chatID, userId)
+	if !ok {
+		return
+	}
+	if chatType, err := getChatType(db, chatID); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get receipts"})
+		return
+	} else if chatType == ChatTypeChannel && role == RoleMember {
+		c.JSON(403, gin.H{"success": false, "error": "only admins can see who read channel posts", "code": ErrorCodePermissionDenied})
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT u.ID, u.FullName, u.Handle, COALESCE(u.AvatarLink, ''), cm.LastReadMessageID >= ?
+		FROM ChatMember cm
+		JOIN User u ON u.ID = cm.UserID
+		WHERE cm.ChatID = ? AND cm.UserID != ? AND cm.LastDeliveredMessageID >= ?
+	`, c.Param("id"), chatID, authorID, c.Param("id"))
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get receipts"})
+		return
+	}
+	defer rows.Close()
+
+	seenBy := []User{}
+	deliveredTo := []User{}
+	for rows.Next() {
+		user := User{}
+		var read bool
+		if err := rows.Scan(&user.ID, &user.FullName, &user.Handle, &user.AvatarLink, &read); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "failed to get receipts"})
+			return
+		}
+		if read {
+			seenBy = append(seenBy, user)
+		} else {
+			deliveredTo = append(deliveredTo, user)
+		}
+	}
+
+	c.JSON(200, gin.H{"success": true, "seenBy": seenBy, "deliveredTo": deliveredTo})
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxReplay is the largest gap a resume replays. Clients further behind
+	// get resync.required and have to reload their chats over REST.
+	maxReplay = 500
+	// eventRetention is how long chat events are kept for replay.
+	eventRetention = 7 * 24 * time.Hour
+	// replaySendTimeout bounds how long a replay waits for room in the send
+	// buffer of a client before giving up on it.
+	replaySendTimeout = 10 * time.Second
+	// eventLockPrefix names the per chat MySQL locks logEvent holds,
+	// eventLockTimeout is how many seconds it waits for one.
+	eventLockPrefix  = "sendiz_chat_events:"
+	eventLockTimeout = 10
+)
+
+type ResumePayload struct {
+	LastSeq int64 `json:"lastSeq"`
+}
+
+type ResumedPayload struct {
+	Replayed int   `json:"replayed"`
+	Seq      int64 `json:"seq"`
+}
+
+func init() {
+	registerCommand(CommandResume, handleResumeCommand)
+}
+
+// logEvent stores a chat event in ChatEvent and hands its sequence number to
+// send. Sequence numbers are the auto increment IDs of the table, so they
+// grow monotonically across all chats. Logging and sending happen under a
+// lock of the chat shared by every instance, so the events of a chat reach
+// the broker in seq order while other chats aren't held up. send isn't called
+// on error.
+func logEvent(db *sql.DB, chatID int64, eventType string, payload json.RawMessage, send func(seq int64)) error {
+	ctx := context.Background()
+	// named locks belong to a connection, so everything runs on one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lock := eventLockPrefix + strconv.FormatInt(chatID, 10)
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, lock, eventLockTimeout).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("timed out waiting for the event lock of chat %d", chatID)
+	}
+	defer conn.ExecContext(ctx, `DO RELEASE_LOCK(?)`, lock)
+
+	res, err := conn.ExecContext(ctx, `INSERT INTO ChatEvent (ChatID, Type, Payload) VALUES (?, ?, ?)`, chatID, eventType, string(payload))
+	if err != nil {
+		return err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	send(seq)
+
+	return nil
+}
+
+// getEventsSince returns the events of the given chats after lastSeq, oldest
+// first. resync is true when the gap can't be replayed, either because it is
+// larger than maxReplay or because part of it was already pruned.
+func getEventsSince(db *sql.DB, chatIDs []int64, lastSeq int64) (events []Envelope, resync bool, err error) {
+	events = []Envelope{}
+	if len(chatIDs) == 0 {
+		return events, false, nil
+	}
+
+	var oldest sql.NullInt64
+	err = db.QueryRow(`SELECT MIN(ID) FROM ChatEvent`).Scan(&oldest)
+	if err != nil {
+		return nil, false, err
+	}
+	if oldest.Valid && lastSeq < oldest.Int64-1 {
+		return nil, true, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chatIDs)), ", ")
+	args := []interface{}{lastSeq}
+	for _, chatID := range chatIDs {
+		args = append(args, chatID)
+	}
+	args = append(args, maxReplay+1)
+
+	rows, err := db.Query(`
+		SELECT ID, ChatID, Type, Payload FROM ChatEvent
+		WHERE ID > ? AND ChatID IN (`+placeholders+`)
+		ORDER BY ID
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		env := Envelope{Version: protocolVersion}
+		var payload string
+		if err := rows.Scan(&env.Seq, &env.ChatID, &env.Type, &payload); err != nil {
+			return nil, false, err
+		}
+		env.Payload = json.RawMessage(payload)
+		events = append(events, env)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(events) > maxReplay {
+		return nil, true, nil
+	}
+
+	return events, false, nil
+}
+
+func handleResumeCommand(client *Client, env Envelope) error {
+	payload := ResumePayload{}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return newWsError(ErrorCodeBadPayload, "payload must contain lastSeq")
+	}
+
+	events, resync, err := getEventsSince(client.db, client.hubs.chatIDs(client), payload.LastSeq)
+	if err != nil {
+		return err
+	}
+
+	if resync {
+		return client.sendEvent(Envelope{Type: EventResyncRequired, ID: env.ID})
+	}
+
+	seq := payload.LastSeq
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		// unlike live events, a replay must not silently lose frames
+		select {
+		case client.send <- data:
+		case <-client.done:
+			return nil
+		case <-time.After(replaySendTimeout):
+			log.Printf("giving up replay for user %d: send queue full", client.id)
+			return nil
+		}
+		seq = event.Seq
+	}
+
+	data, err := json.Marshal(ResumedPayload{Replayed: len(events), Seq: seq})
+	if err != nil {
+		return err
+	}
+
+	return client.sendEvent(Envelope{Type: EventResumed, ID: env.ID, Payload: data})
+}
+
+// pruneEvents deletes chat events older than eventRetention once an hour.
+func pruneEvents(db *sql.DB) {
+	for {
+		_, err := db.Exec(`DELETE FROM ChatEvent WHERE Created < NOW() - INTERVAL ? SECOND`, int64(eventRetention.Seconds()))
+		if err != nil {
+			log.Printf("error pruning chat events: %s", err.Error())
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every edit of a message is kept as a MessageRevision. The first edit also
+// stores the text the message was sent with, so the history always starts
+// with what was originally said. Chats may limit for how long after sending
+// a message can be edited, and deleted for everyone, see deletions.go.
+
+var errEditWindowExpired = errors.New("this message can't be edited anymore")
+
+// windowPassed reports whether the chat's window of the message has passed.
+// window is a column of Chat holding seconds, 0 meaning no limit.
+func windowPassed(db *sql.DB, messageID int64, window string) (bool, error) {
+	var passed bool
+	err := db.QueryRow(`
+		SELECT c.`+window+` > 0 AND m.Timestamp < NOW() - INTERVAL c.`+window+` SECOND
+		FROM Message m
+		JOIN Chat c ON c.ID = m.ChatID
+		WHERE m.ID = ?
+	`, messageID).Scan(&passed)
+
+	return passed, err
+}
+
+// checkEditWindow returns errEditWindowExpired if the chat's edit window of
+// the message has passed.
+func checkEditWindow(db *sql.DB, messageID int64) error {
+	passed, err := windowPassed(db, messageID, "EditWindow")
+	if err != nil {
+		return err
+	}
+	if passed {
+		return errEditWindowExpired
+	}
+
+	return nil
+}
+
+// saveRevision stores the new text of a message, preceded by its original
+// text if this is its first edit.
+func saveRevision(tx *sql.Tx, message Message, actorID int64, text string) error {
+	var edited bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM MessageRevision WHERE MessageID = ?)`, message.ID).Scan(&edited)
+	if err != nil {
+		return err
+	}
+
+	if !edited {
+		_, err = tx.Exec(`INSERT INTO MessageRevision (MessageID, TextContent, EditedBy, Created) VALUES (?, ?, ?, ?)`, message.ID, message.TextContent, message.UserID, message.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO MessageRevision (MessageID, TextContent, EditedBy) VALUES (?, ?, ?)`, message.ID, text, actorID)
+
+	return err
+}
+
+// handleGetMessageHistory returns the versions of a message, oldest first.
+// Like editing, it is open to the author and to owners and admins of the chat.
+func handleGetMessageHistory(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	messageID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	message := Message{ID: messageID}
+	err := db.QueryRow(`SELECT ChatID, UserID FROM Message WHERE ID = ?`, messageID).Scan(&message.ChatID, &message.UserID)
+	if err == sql.ErrNoRows {
+		err = errMessageNotFound
+	}
+	if err == nil {
+		err = authorizeMessageChange(db, userId, message)
+	}
+	if err != nil {
+		writeMessageError(c, err, "failed to get message history")
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT ID, MessageID, TextContent, EditedBy, Created
+		FROM MessageRevision
+		WHERE MessageID = ?
+		ORDER BY ID
+	`, messageID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get message history"})
+		return
+	}
+	defer rows.Close()
+
+	revisions := []MessageRevision{}
+	for rows.Next() {
+		revision := MessageRevision{}
+		if err := rows.Scan(&revision.ID, &revision.MessageID, &revision.Text, &revision.EditedBy, &revision.Created); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "failed to get message history"})
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get message history"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "revisions": revisions})
+}
+
+// handleUpdateChatLimits sets for how many seconds messages of the chat stay
+// editable and can be deleted for everyone, 0 for ever.
+// Only the owner and admins may.
+func handleUpdateChatLimits(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		EditWindow   *int `json:"editWindow"`
+		DeleteWindow *int `json:"deleteWindow"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+	if (reqBody.EditWindow != nil && *reqBody.EditWindow < 0) || (reqBody.DeleteWindow != nil && *reqBody.DeleteWindow < 0) {
+		c.JSON(400, gin.H{"success": false, "error": "windows can't be negative"})
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId, RoleOwner, RoleAdmin); !ok {
+		return
+	}
+
+	changed := reqBody.EditWindow != nil || reqBody.DeleteWindow != nil
+	if changed {
+		_, err := db.Exec(`
+			UPDATE Chat
+			SET EditWindow = COALESCE(?, EditWindow), DeleteWindow = COALESCE(?, DeleteWindow)
+			WHERE ID = ?
+		`, reqBody.EditWindow, reqBody.DeleteWindow, chatID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error updating chat"})
+			return
+		}
+	}
+
+	chat, err := getChat(db, chatID)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error reading chat"})
+		return
+	}
+	if changed {
+		hubs.publish(chatID, EventChatUpdated, chat)
+	}
+
+	c.JSON(200, gin.H{"success": true, "chat": chat})
+}
@@ -2,6 +2,10 @@ package server
 
 import (
 	"database/sql"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -9,6 +13,9 @@ import (
 
 func StartServer(db *sql.DB) {
 	router := gin.Default()
+	hubs := newHubManager(db, newBroker())
+	go pruneEvents(db)
+	go serveDebug()
 	defer router.Run("0.0.0.0:8080")
 
 	config := cors.DefaultConfig()
@@ -21,6 +28,22 @@ func StartServer(db *sql.DB) {
 			"message": "pong",
 		})
 	})
-	setupApi(router, db)
-	setupWebSocket(router, db)
+	setupApi(router, db, hubs)
+	setupWebSocket(router, db, hubs)
+}
+
+// serveDebug serves the expvar counters on /debug/vars of DEBUG_ADDR, which
+// defaults to localhost only. They expose the command line and memory
+// stats, so they are never served on the public port.
+func serveDebug() {
+	addr := os.Getenv("DEBUG_ADDR")
+	if addr == "" {
+		addr = "127.0.0.1:6060"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("error serving debug vars on %s: %s", addr, err.Error())
+	}
 }
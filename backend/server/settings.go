@@ -0,0 +1,253 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Personal chat settings of a member. A muted chat sends no notifications,
+// an archived chat is left out of the inbox until a new message arrives
+// (unless it is also muted) and pinned chats come first in the inbox.
+// Notifications are notification events sent to the user's connections for
+// every new message their settings allow.
+
+const (
+	NotificationAll      = "all"
+	NotificationMentions = "mentions"
+	NotificationNone     = "none"
+)
+
+// mutedForever is the MutedUntil of a chat muted without end.
+const mutedForever = "9999-12-31 23:59:59"
+
+func isValidNotificationLevel(level string) bool {
+	switch level {
+	case NotificationAll, NotificationMentions, NotificationNone:
+		return true
+	}
+
+	return false
+}
+
+func getChatSettings(db *sql.DB, chatID, userID int64) (ChatSettings, error) {
+	settings := ChatSettings{ChatID: chatID}
+	var mutedUntil sql.NullString
+	err := db.QueryRow(`
+		SELECT COALESCE(MutedUntil > NOW(), FALSE), IF(MutedUntil > NOW(), MutedUntil, NULL), PinnedAt IS NOT NULL, Archived, NotificationLevel
+		FROM ChatMember
+		WHERE ChatID = ? AND UserID = ?
+	`, chatID, userID).Scan(&settings.Muted, &mutedUntil, &settings.Pinned, &settings.Archived, &settings.NotificationLevel)
+	if mutedUntil.Valid {
+		settings.MutedUntil = &mutedUntil.String
+	}
+
+	return settings, err
+}
+
+// sendSettings tells the other connections of the user about new settings.
+func sendSettings(hubs *HubManager, userID int64, settings ChatSettings) {
+	data, err := newEvent(EventChatSettingsUpdated, settings.ChatID, settings)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	hubs.sendToUser(userID, data)
+}
+
+func handleGetChatSettings(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	settings, err := getChatSettings(db, chatID, userId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting settings"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "settings": settings})
+}
+
+// handleUpdateChatSettings changes the settings present in the body and
+// leaves the others as they are.
+func handleUpdateChatSettings(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	chatID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		MuteFor           *int64  `json:"muteFor"` // seconds, 0 unmutes, -1 mutes forever
+		Pinned            *bool   `json:"pinned"`
+		Archived          *bool   `json:"archived"`
+		NotificationLevel *string `json:"notificationLevel"`
+	}
+	if err := c.BindJSON(&reqBody); err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid request body"})
+		return
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	if reqBody.MuteFor != nil {
+		switch muteFor := *reqBody.MuteFor; {
+		case muteFor == -1:
+			sets = append(sets, "MutedUntil = ?")
+			args = append(args, mutedForever)
+		case muteFor == 0:
+			sets = append(sets, "MutedUntil = NULL")
+		case muteFor > 0:
+			sets = append(sets, "MutedUntil = NOW() + INTERVAL ? SECOND")
+			args = append(args, muteFor)
+		default:
+			c.JSON(400, gin.H{"success": false, "error": "muteFor must be -1, 0 or a number of seconds"})
+			return
+		}
+	}
+	if reqBody.Pinned != nil {
+		if *reqBody.Pinned {
+			sets = append(sets, "PinnedAt = COALESCE(PinnedAt, NOW())")
+		} else {
+			sets = append(sets, "PinnedAt = NULL")
+		}
+	}
+	if reqBody.Archived != nil {
+		sets = append(sets, "Archived = ?")
+		args = append(args, *reqBody.Archived)
+	}
+	if reqBody.NotificationLevel != nil {
+		if !isValidNotificationLevel(*reqBody.NotificationLevel) {
+			c.JSON(400, gin.H{"success": false, "error": "notificationLevel must be all, mentions or none"})
+			return
+		}
+		sets = append(sets, "NotificationLevel = ?")
+		args = append(args, *reqBody.NotificationLevel)
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	if len(sets) > 0 {
+		args = append(args, chatID, userId)
+		_, err := db.Exec(`UPDATE ChatMember SET `+strings.Join(sets, ", ")+` WHERE ChatID = ? AND UserID = ?`, args...)
+		if err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "error updating settings"})
+			return
+		}
+	}
+
+	settings, err := getChatSettings(db, chatID, userId)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "error getting settings"})
+		return
+	}
+	if len(sets) > 0 {
+		sendSettings(hubs, userId, settings)
+	}
+
+	c.JSON(200, gin.H{"success": true, "settings": settings})
+}
+
+// mentionRegexp finds @handle mentions; the handle runs until the first
+// character a handle can't contain, so @bob doesn't match @bobby.
+var mentionRegexp = regexp.MustCompile(`(?:^|[^a-zA-Z0-9_])@([a-zA-Z0-9_]+)`)
+
+// getMentions returns the lower cased handles mentioned in the text.
+func getMentions(text string) map[string]bool {
+	mentions := make(map[string]bool)
+	for _, match := range mentionRegexp.FindAllStringSubmatch(text, -1) {
+		mentions[strings.ToLower(match[1])] = true
+	}
+
+	return mentions
+}
+
+// notifyMembers sends a notification for a new message to every other member
+// whose settings allow it, and brings the chat out of the archive of members
+// who haven't muted it.
+func notifyMembers(db *sql.DB, hubs *HubManager, message Message) {
+	rows, err := db.Query(`
+		SELECT cm.UserID, u.Handle, cm.NotificationLevel, COALESCE(cm.MutedUntil > NOW(), FALSE), cm.Archived, COALESCE(ts.Following, FALSE)
+		FROM ChatMember cm
+		JOIN User u ON u.ID = cm.UserID
+		LEFT JOIN ThreadSubscription ts ON ts.MessageID = ? AND ts.UserID = cm.UserID
+		WHERE cm.ChatID = ? AND cm.UserID <> ?
+	`, message.ThreadID, message.ChatID, message.UserID)
+	if err != nil {
+		log.Printf("error getting members to notify in chat %d: %s", message.ChatID, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	mentioned := getMentions(message.TextContent)
+	unarchive := []int64{}
+	for rows.Next() {
+		var userID int64
+		var handle, level string
+		var muted, archived, following bool
+		if err := rows.Scan(&userID, &handle, &level, &muted, &archived, &following); err != nil {
+			log.Println(err)
+			return
+		}
+
+		if archived && !muted {
+			unarchive = append(unarchive, userID)
+		}
+
+		// following a thread overrides the notification level, not muting
+		mentions := mentioned[strings.ToLower(handle)]
+		if muted || (!following && (level == NotificationNone || (level == NotificationMentions && !mentions))) {
+			continue
+		}
+
+		data, err := newEvent(EventNotification, message.ChatID, NotificationPayload{Message: message, Mentions: mentions, Thread: following})
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		hubs.sendToUser(userID, data)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(unarchive) == 0 {
+		return
+	}
+	_, err = db.Exec(`UPDATE ChatMember SET Archived = FALSE WHERE ChatID = ? AND UserID IN (`+placeholders(len(unarchive))+`)`,
+		append([]interface{}{message.ChatID}, int64Args(unarchive)...)...)
+	if err != nil {
+		log.Printf("error unarchiving chat %d: %s", message.ChatID, err.Error())
+		return
+	}
+	for _, userID := range unarchive {
+		settings, err := getChatSettings(db, message.ChatID, userID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		sendSettings(hubs, userID, settings)
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestGetMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hi @bob", []string{"bob"}},
+		{"hi @bobby", []string{"bobby"}},
+		{"@Bob, @alice_1!", []string{"bob", "alice_1"}},
+		{"@bob@carol", []string{"bob"}},
+		{"mail bob@example.com", nil},
+		{"no mentions", nil},
+	}
+
+	for _, test := range tests {
+		got := getMentions(test.text)
+		if len(got) != len(test.want) {
+			t.Errorf("getMentions(%q) = %v, want %v", test.text, got, test.want)
+			continue
+		}
+		for _, handle := range test.want {
+			if !got[handle] {
+				t.Errorf("getMentions(%q) = %v, want %v", test.text, got, test.want)
+			}
+		}
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func setupApi(router *gin.Engine, db *sql.DB) {
+func setupApi(router *gin.Engine, db *sql.DB, hubs *HubManager) {
 
 	v1 := router.Group("/api/v1")
-	addUserRoutes(v1, db)
-	addMessageRoutes(v1, db)
-	addChatRoutes(v1, db)
+	addUserRoutes(v1, db, hubs)
+	addMessageRoutes(v1, db, hubs)
+	addChatRoutes(v1, db, hubs)
+	addInviteRoutes(v1, db, hubs)
+	addEventRoutes(v1, db, hubs)
 }
@@ -3,21 +3,90 @@ package server
 import (
 	"database/sql"
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
+// wsSubprotocol is selected during the handshake when the client offers it.
+// Browsers can't set headers on a WebSocket, so they pass the token as a second
+// subprotocol prefixed with wsTokenPrefix, e.g. ["sendiz", "bearer.<jwt>"].
+const (
+	wsSubprotocol = "sendiz"
+	wsTokenPrefix = "bearer."
+)
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{wsSubprotocol},
 }
 
-func setupWebSocket(router *gin.Engine, db *sql.DB) {
-	router.GET("/ws", wsHandler)
+func setupWebSocket(router *gin.Engine, db *sql.DB, hubs *HubManager) {
+	config := loadWsConfig()
+	router.GET("/ws", wsAuthMiddleWare, func(c *gin.Context) {
+		wsHandler(c, db, hubs, config)
+	})
+}
+
+// wsAuthMiddleWare works like authMiddleWare but also accepts the token from
+// the subprotocol list or the `token` query parameter. It runs before the
+// upgrade so unauthenticated sockets are refused with a plain 401. The SSE
+// stream uses it too, since EventSource can't set headers either.
+func wsAuthMiddleWare(c *gin.Context) {
+	token := getWsToken(c)
+	if token == "" {
+		c.JSON(401, gin.H{"error": "Authorization token required"})
+		c.Abort()
+		return
+	}
+
+	userId, err := parseTokenString(token)
+	if err != nil {
+		c.JSON(401, gin.H{"error": tokenErrorMessage(err)})
+		c.Abort()
+		return
+	}
+
+	c.Set("userId", userId)
+
+	c.Next()
+}
+
+func getWsToken(c *gin.Context) string {
+	if auth := c.Request.Header.Get("Authorization"); auth != "" {
+		token, found := strings.CutPrefix(auth, "Bearer ")
+		if !found {
+			return ""
+		}
+		return token
+	}
+
+	for _, protocol := range websocket.Subprotocols(c.Request) {
+		if token, found := strings.CutPrefix(protocol, wsTokenPrefix); found {
+			return token
+		}
+	}
+
+	return c.Query("token")
 }
 
-func wsHandler(c *gin.Context) {
+func wsHandler(c *gin.Context, db *sql.DB, hubs *HubManager, config *wsConfig) {
+	userId, err := strconv.ParseInt(c.GetString("userId"), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "invalid token"})
+		return
+	}
+
+	chatIDs, err := getUserChatIDs(db, userId)
+	if err != nil {
+		log.Printf("error getting chats of user %d: %s", userId, err.Error())
+		c.JSON(500, gin.H{"error": "error getting chats"})
+		return
+	}
+
 	// Upgrade HTTP request to WebSocket
 	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -25,23 +94,51 @@ func wsHandler(c *gin.Context) {
 		return
 	}
 
-	// Listen indefinitely for new messages coming through on the WebSocket
-	for {
-		// Read message from browser
-		msgType, msg, err := ws.ReadMessage()
-		if err != nil {
-			log.Println(err)
-			return
-		}
+	client := &Client{
+		id:     userId,
+		socket: ws,
+		send:   make(chan []byte, config.sendQueueSize),
+		done:   make(chan struct{}),
+		chats:  make(map[int64]bool),
+		db:     db,
+		hubs:   hubs,
+		config: config,
+	}
+	wsConnections.Add(1)
+	if hubs.connect(client) {
+		userOnline(db, hubs, userId)
+	}
+	hubs.subscribe(client, chatIDs)
+
+	go client.writePump()
+	client.readPump()
 
-		// Print the message to the console
-		log.Printf("%s sent: %s\n", ws.RemoteAddr(), string(msg))
+	// forget the connection first so a concurrent join can't subscribe it again
+	offline := hubs.disconnect(client)
+	hubs.unsubscribe(client)
+	if offline {
+		// other devices of the user may still be typing
+		hubs.stopUserTyping(userId)
+		userOffline(db, hubs, userId)
+	}
+	wsConnections.Add(-1)
+}
 
-		// Echo the message back to the browser
-		err = ws.WriteMessage(msgType, msg)
-		if err != nil {
-			log.Println(err)
-			return
+func getUserChatIDs(db *sql.DB, userId int64) ([]int64, error) {
+	rows, err := db.Query(`SELECT ChatID FROM ChatMember WHERE UserID = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chatIDs := []int64{}
+	for rows.Next() {
+		var chatID int64
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
 		}
+		chatIDs = append(chatIDs, chatID)
 	}
+
+	return chatIDs, rows.Err()
 }
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/v1/events streams the same envelopes as /ws as Server-Sent Events,
+// for clients behind proxies that block WebSocket upgrades. It is read only,
+// such clients send through the REST endpoints. Every SSE event is named
+// after the envelope type and carries the whole envelope as data; logged chat
+// events use their seq as event id, so a reconnecting EventSource resumes
+// through Last-Event-ID on its own. EventSource can't set headers, the token
+// may be passed as the `token` query parameter.
+
+func addEventRoutes(router *gin.RouterGroup, db *sql.DB, hubs *HubManager) {
+	config := loadWsConfig()
+	router.GET("/events", wsAuthMiddleWare, func(c *gin.Context) {
+		handleEventStream(c, db, hubs, config)
+	})
+}
+
+func handleEventStream(c *gin.Context, db *sql.DB, hubs *HubManager, config *wsConfig) {
+	userId, err := strconv.ParseInt(c.GetString("userId"), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "invalid token"})
+		return
+	}
+
+	chatIDs, err := getUserChatIDs(db, userId)
+	if err != nil {
+		log.Printf("error getting chats of user %d: %s", userId, err.Error())
+		c.JSON(500, gin.H{"error": "error getting chats"})
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	var lastSeq int64
+	if lastEventID != "" {
+		lastSeq, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	// the client has no socket; the hubs only ever touch send and done
+	client := &Client{
+		id:     userId,
+		send:   make(chan []byte, config.sendQueueSize),
+		done:   make(chan struct{}),
+		chats:  make(map[int64]bool),
+		db:     db,
+		hubs:   hubs,
+		config: config,
+	}
+	if hubs.connect(client) {
+		userOnline(db, hubs, userId)
+	}
+	hubs.subscribe(client, chatIDs)
+	defer func() {
+		offline := hubs.disconnect(client)
+		hubs.unsubscribe(client)
+		if offline {
+			userOffline(db, hubs, userId)
+		}
+	}()
+
+	// the gap is read after subscribing, so an event published in between is
+	// either replayed or queued live; live ones the replay covered are dropped
+	var missed []Envelope
+	resync := false
+	if lastEventID != "" {
+		missed, resync, err = getEventsSince(db, chatIDs, lastSeq)
+		if err != nil {
+			log.Printf("error getting missed events of user %d: %s", userId, err.Error())
+			c.JSON(500, gin.H{"error": "error getting missed events"})
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	// send the headers right away, the stream may stay quiet for a while
+	c.Status(200)
+	c.Writer.Flush()
+
+	if resync {
+		data, _ := marshalEnvelope(Envelope{Type: EventResyncRequired})
+		writeSSE(c, data)
+	}
+	replayed := lastSeq
+	for _, event := range missed {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		writeSSE(c, data)
+		replayed = event.Seq
+	}
+
+	ticker := time.NewTicker(config.pingInterval)
+	defer ticker.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case data := <-client.send:
+			if _, seq := envelopeHeader(data); seq != 0 && seq <= replayed {
+				return true
+			}
+			writeSSE(c, data)
+			return true
+		case <-ticker.C:
+			// a comment line keeps proxies from timing the stream out
+			_, err := io.WriteString(w, ":\n\n")
+			return err == nil
+		case <-client.done:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// envelopeHeader returns the type and seq of a serialized envelope.
+func envelopeHeader(data []byte) (string, int64) {
+	var header struct {
+		Type string `json:"type"`
+		Seq  int64  `json:"seq"`
+	}
+	json.Unmarshal(data, &header)
+
+	return header.Type, header.Seq
+}
+
+// writeSSE writes an envelope as one SSE event.
+func writeSSE(c *gin.Context, data []byte) {
+	eventType, seq := envelopeHeader(data)
+
+	event := sse.Event{Event: eventType, Data: string(data)}
+	if seq != 0 {
+		event.Id = strconv.FormatInt(seq, 10)
+	}
+	c.Render(-1, event)
+	c.Writer.Flush()
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Threads are flat: a reply joins the thread of the message it replies to,
+// or starts one on it, and Message.ThreadID always points to the root.
+// Authors of the root and of replies follow the thread automatically; a
+// followed thread notifies its replies even if the chat's notification
+// level wouldn't. ThreadSubscription keeps unfollowed threads too, with
+// Following false, so replying later doesn't follow them again.
+
+const (
+	threadPageSize    = 50
+	maxThreadPageSize = 100
+	snippetLength     = 100
+	maxLastRepliers   = 3
+)
+
+// followThread makes the user and the author of the root follow the thread,
+// unless they unfollowed it before.
+func followThread(db *sql.DB, rootID, userID int64) {
+	_, err := db.Exec(`
+		INSERT IGNORE INTO ThreadSubscription (MessageID, UserID)
+		SELECT ID, UserID FROM Message WHERE ID = ?
+		UNION
+		SELECT ?, ?
+	`, rootID, rootID, userID)
+	if err != nil {
+		log.Printf("error following thread %d: %s", rootID, err.Error())
+	}
+}
+
+// getReplyPreviews returns a quote of each of the messages, keyed by ID.
+func getReplyPreviews(db *sql.DB, ids []int64) (map[int64]ReplyPreview, error) {
+	previews := make(map[int64]ReplyPreview)
+	if len(ids) == 0 {
+		return previews, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT m.ID, m.UserID, LEFT(COALESCE(m.TextContent, ''), ?), COALESCE(m.ThreadID, m.ID),
+			m.DeletedAt IS NULL AND EXISTS (SELECT 1 FROM Attachament WHERE MessageID = m.ID), m.DeletedAt IS NOT NULL
+		FROM Message m
+		WHERE m.ID IN (`+placeholders(len(ids))+`)
+	`, append([]interface{}{snippetLength}, int64Args(ids)...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		preview := ReplyPreview{}
+		if err := rows.Scan(&preview.ID, &preview.UserID, &preview.Snippet, &preview.threadID, &preview.HasAttachament, &preview.Deleted); err != nil {
+			return nil, err
+		}
+		previews[preview.ID] = preview
+	}
+
+	return previews, rows.Err()
+}
+
+// getThreadInfos returns reply count and last repliers of the threads rooted
+// at the given messages. Messages without replies are left out.
+func getThreadInfos(db *sql.DB, rootIDs []int64) (map[int64]*ThreadInfo, error) {
+	threads := make(map[int64]*ThreadInfo)
+	if len(rootIDs) == 0 {
+		return threads, nil
+	}
+
+	rows, err := db.Query(`
+		SELECT ThreadID, COUNT(*), MAX(Timestamp)
+		FROM Message
+		WHERE ThreadID IN (`+placeholders(len(rootIDs))+`)
+		GROUP BY ThreadID
+	`, int64Args(rootIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rootID int64
+		thread := &ThreadInfo{LastRepliers: []int64{}}
+		if err := rows.Scan(&rootID, &thread.ReplyCount, &thread.LastReplyAt); err != nil {
+			return nil, err
+		}
+		threads[rootID] = thread
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	repliers, err := db.Query(`
+		SELECT ThreadID, UserID
+		FROM Message
+		WHERE ThreadID IN (`+placeholders(len(rootIDs))+`)
+		GROUP BY ThreadID, UserID
+		ORDER BY ThreadID, MAX(ID) DESC
+	`, int64Args(rootIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer repliers.Close()
+
+	for repliers.Next() {
+		var rootID, userID int64
+		if err := repliers.Scan(&rootID, &userID); err != nil {
+			return nil, err
+		}
+		if thread := threads[rootID]; thread != nil && len(thread.LastRepliers) < maxLastRepliers {
+			thread.LastRepliers = append(thread.LastRepliers, userID)
+		}
+	}
+
+	return threads, repliers.Err()
+}
+
+// addMessageDetails fills attachaments, reply quotes and thread infos of a
+// page of messages with a fixed number of queries.
+func addMessageDetails(db *sql.DB, messages []Message) error {
+	ids := make([]int64, 0, len(messages))
+	replyToIDs := []int64{}
+	for _, message := range messages {
+		ids = append(ids, message.ID)
+		if message.ReplyToId != 0 {
+			replyToIDs = append(replyToIDs, message.ReplyToId)
+		}
+	}
+
+	attachaments, err := getAttachaments(db, ids)
+	if err != nil {
+		return err
+	}
+	previews, err := getReplyPreviews(db, replyToIDs)
+	if err != nil {
+		return err
+	}
+	threads, err := getThreadInfos(db, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		message.Attachaments = attachaments[message.ID]
+		if message.Attachaments == nil {
+			message.Attachaments = []Attachament{}
+		}
+		if preview, ok := previews[message.ReplyToId]; ok {
+			message.ReplyPreview = &preview
+		}
+		message.Thread = threads[message.ID]
+	}
+
+	return nil
+}
+
+// handleGetThread returns the root of the thread the message belongs to and
+// a page of its replies, oldest first. Pass the ID of the last reply as
+// ?after= to get the next page.
+func handleGetThread(c *gin.Context, db *sql.DB) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	messageID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	after, err := strconv.ParseInt(c.DefaultQuery("after", "0"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid after"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(threadPageSize)))
+	if err != nil || limit <= 0 || limit > maxThreadPageSize {
+		c.JSON(400, gin.H{"success": false, "error": "limit must be between 1 and " + strconv.Itoa(maxThreadPageSize)})
+		return
+	}
+
+	var chatID, rootID int64
+	err = db.QueryRow(`SELECT ChatID, COALESCE(ThreadID, ID) FROM Message WHERE ID = ?`, messageID).Scan(&chatID, &rootID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "message not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get thread"})
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	// the root is returned even if the user hid it, so the thread has a head
+	rows, err := db.Query(`SELECT `+messageColumns+` FROM Message WHERE ID = ? OR (ThreadID = ? AND ID > ? AND `+notHidden+`) ORDER BY ID LIMIT ?`, rootID, rootID, after, userId, limit+2)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get thread"})
+		return
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		message := Message{}
+		if err := scanMessage(rows, &message); err != nil {
+			log.Println(err)
+			c.JSON(500, gin.H{"success": false, "error": "failed to get thread"})
+			return
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get thread"})
+		return
+	}
+	if len(messages) == 0 || messages[0].ID != rootID {
+		c.JSON(404, gin.H{"success": false, "error": "message not found"})
+		return
+	}
+
+	if err := addMessageDetails(db, messages); err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to get thread"})
+		return
+	}
+
+	root, replies := messages[0], messages[1:]
+	hasMore := len(replies) > limit
+	if hasMore {
+		replies = replies[:limit]
+	}
+
+	var following bool
+	err = db.QueryRow(`SELECT Following FROM ThreadSubscription WHERE MessageID = ? AND UserID = ?`, rootID, userId).Scan(&following)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+	}
+
+	c.JSON(200, gin.H{"success": true, "root": root, "replies": replies, "hasMore": hasMore, "following": following})
+}
+
+// handleFollowThread follows or unfollows the thread the message belongs to.
+func handleFollowThread(c *gin.Context, db *sql.DB, follow bool) {
+	userId, ok := getUserId(c)
+	if !ok {
+		return
+	}
+	messageID, ok := getIdParam(c, "id")
+	if !ok {
+		return
+	}
+
+	var chatID, rootID int64
+	err := db.QueryRow(`SELECT ChatID, COALESCE(ThreadID, ID) FROM Message WHERE ID = ?`, messageID).Scan(&chatID, &rootID)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"success": false, "error": "message not found"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to update thread subscription"})
+		return
+	}
+
+	if _, ok := requireRole(c, db, chatID, userId); !ok {
+		return
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO ThreadSubscription (MessageID, UserID, Following) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE Following = VALUES(Following)
+	`, rootID, userId, follow)
+	if err != nil {
+		log.Println(err)
+		c.JSON(500, gin.H{"success": false, "error": "failed to update thread subscription"})
+		return
+	}
+
+	c.JSON(200, gin.H{"success": true, "threadId": rootID, "following": follow})
+}
@@ -1,15 +1,33 @@
 package server
 
-import "github.com/gorilla/websocket"
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 type User struct {
-	ID         int64  `json:"id"`
-	FullName   string `json:"fullName"`
-	Handle     string `json:"handle"`
-	Phone      string `json:"phone"`
-	AvatarLink string `json:"avatarLink"`
+	ID              int64   `json:"id"`
+	FullName        string  `json:"fullName"`
+	Handle          string  `json:"handle"`
+	Phone           string  `json:"phone,omitempty"`
+	AvatarLink      string  `json:"avatarLink"`
+	Online          bool    `json:"online,omitempty"` // presence is only set on single user lookups
+	LastSeen        *string `json:"lastSeen,omitempty"`
+	LastSeenPrivacy string  `json:"lastSeenPrivacy,omitempty"`
+	Role            string  `json:"role,omitempty"` // role in the chat, only set in Chat.Members
 }
 
+// who may see a user's online state and last seen time
+const (
+	LastSeenEveryone = "everyone"
+	LastSeenChats    = "chats"
+	LastSeenNobody   = "nobody"
+)
+
 type UserInitiate struct {
 	ID    int64  `json:"id"`
 	Phone string `json:"phone"`
@@ -28,17 +46,88 @@ type UserVerificationClient struct {
 }
 
 type ChatMember struct {
-	ID     int64  `json:"id"`
-	ChatID int64  `json:"chatId"`
-	UserID int64  `json:"userId"`
-	Role   string `json:"role"`
+	ID                     int64  `json:"id"`
+	ChatID                 int64  `json:"chatId"`
+	UserID                 int64  `json:"userId"`
+	Role                   string `json:"role"`
+	LastDeliveredMessageID int64  `json:"lastDeliveredMessageId"`
+	LastReadMessageID      int64  `json:"lastReadMessageId"`
+
+	// permission overrides, only set on chat.member_updated after they change
+	Permissions map[string]bool `json:"permissions,omitempty"`
 }
 
 type Chat struct {
+	ID              int64           `json:"id"`
+	Name            string          `json:"name"`
+	ChatType        string          `json:"chatType"`
+	Handle          string          `json:"handle,omitempty"`          // public channels only
+	SubscriberCount int             `json:"subscriberCount,omitempty"` // channels only
+	Permissions     map[string]bool `json:"permissions,omitempty"`     // groups only, defaults for plain members
+	EditWindow      int             `json:"editWindow"`                // seconds messages stay editable, 0 for ever
+	DeleteWindow    int             `json:"deleteWindow"`              // seconds messages can be deleted for everyone, 0 for ever
+	Members         []User          `json:"members"`
+}
+
+// InboxChat is one entry of the caller's chat list.
+type InboxChat struct {
+	ID                int64    `json:"id"`
+	Name              string   `json:"name"`
+	ChatType          string   `json:"chatType"`
+	Role              string   `json:"role"`
+	Peer              *User    `json:"peer,omitempty"` // the other member of a direct chat
+	LastMessage       *Message `json:"lastMessage"`
+	LastReadMessageID int64    `json:"lastReadMessageId"`
+	UnreadCount       int      `json:"unreadCount"`
+	Muted             bool     `json:"muted"`
+	MutedUntil        *string  `json:"mutedUntil"`
+	Pinned            bool     `json:"pinned"`
+	Archived          bool     `json:"archived"`
+	NotificationLevel string   `json:"notificationLevel"`
+}
+
+// ChatSettings are the personal settings of a member for one chat.
+type ChatSettings struct {
+	ChatID            int64   `json:"chatId"`
+	Muted             bool    `json:"muted"`
+	MutedUntil        *string `json:"mutedUntil"` // mutedForever when muted without end
+	Pinned            bool    `json:"pinned"`
+	Archived          bool    `json:"archived"`
+	NotificationLevel string  `json:"notificationLevel"`
+}
+
+type NotificationPayload struct {
+	Message  Message `json:"message"`
+	Mentions bool    `json:"mentions"` // the message mentions the user
+	Thread   bool    `json:"thread"`   // the message is a reply in a thread the user follows
+}
+
+type PinnedMessage struct {
+	MessageID int64    `json:"messageId"`
+	PinnedBy  int64    `json:"pinnedBy"`
+	PinnedAt  string   `json:"pinnedAt"`
+	Message   *Message `json:"message,omitempty"` // only set by the list endpoint
+}
+
+type ChatInvite struct {
+	ID               int64   `json:"id"`
+	ChatID           int64   `json:"chatId"`
+	Token            string  `json:"token"`
+	CreatedBy        int64   `json:"createdBy"`
+	Created          string  `json:"created"`
+	ExpiresAt        *string `json:"expiresAt"`
+	MaxUses          int     `json:"maxUses"` // 0 means unlimited
+	Uses             int     `json:"uses"`
+	RequiresApproval bool    `json:"requiresApproval"`
+	Revoked          bool    `json:"revoked"`
+}
+
+type ChatJoinRequest struct {
 	ID       int64  `json:"id"`
-	Name     string `json:"name"`
-	ChatType string `json:"chatType"`
-	Members  []User `json:"members"`
+	ChatID   int64  `json:"chatId"`
+	InviteID int64  `json:"inviteId"`
+	Created  string `json:"created"`
+	User     User   `json:"user"`
 }
 
 type Attachament struct {
@@ -56,19 +145,96 @@ type Message struct {
 	Attachaments []Attachament `json:"attachaments"`
 	Timestamp    string        `json:"timestamp"`
 	WasEdited    bool          `json:"wasEdited"`
+	EditedAt     *string       `json:"editedAt"`
+	DeletedAt    *string       `json:"deletedAt"` // set on tombstones, which have no content and no attachaments
 	ReplyToId    int64         `json:"replyTo"`
+	ReplyPreview *ReplyPreview `json:"replyPreview,omitempty"` // quote of the ReplyToId message
+	ThreadID     int64         `json:"threadId,omitempty"`     // root of the thread a reply belongs to
+	Thread       *ThreadInfo   `json:"thread,omitempty"`       // set on roots that have replies
+	IsSystem     bool          `json:"isSystem"`               // written by the server, e.g. "Alice added Bob"
+	ClientID     string        `json:"clientId,omitempty"`     // not stored, only echoed on message.created
+}
+
+// MessageRevision is one version of the text of an edited message; the first
+// one is the text it was sent with.
+type MessageRevision struct {
+	ID        int64  `json:"id"`
+	MessageID int64  `json:"messageId"`
+	Text      string `json:"content"`
+	EditedBy  int64  `json:"editedBy"`
+	Created   string `json:"created"`
+}
+
+type ReplyPreview struct {
+	ID             int64  `json:"id"`
+	UserID         int64  `json:"userId"`
+	Snippet        string `json:"snippet"`
+	HasAttachament bool   `json:"hasAttachament"`
+	Deleted        bool   `json:"deleted"`
+
+	threadID int64 // thread a reply to this message joins
+}
+
+type ThreadInfo struct {
+	ReplyCount   int     `json:"replyCount"`
+	LastReplyAt  string  `json:"lastReplyAt"`
+	LastRepliers []int64 `json:"lastRepliers"` // most recent first
 }
 
 type Client struct {
-	id     int64
-	socket *websocket.Conn
-	send   chan []byte
+	id        int64 // ID of the authenticated User
+	socket    *websocket.Conn
+	send      chan []byte   // bounded queue drained by writePump
+	done      chan struct{} // closed by close
+	closeOnce sync.Once
+	chats     map[int64]bool
+	db        *sql.DB
+	hubs      *HubManager
+	config    *wsConfig
 }
 
 type Hub struct {
 	id         int64
-	broadcast  chan []byte
+	broadcast  chan hubMessage
 	register   chan *Client
 	unregister chan *Client
+	stop       chan struct{} // closed by the manager once the last client is gone
 	clients    map[*Client]bool
+
+	subscribers int // clients registered, guarded by HubManager.mu
+}
+
+// hubMessage is what travels through the Broker: a broadcast to a chat, a
+// frame for every connection of one user when UserID is set, or a change of
+// who is subscribed to a chat when Join or Leave are set.
+type hubMessage struct {
+	ChatID  int64           `json:"chatId,omitempty"`
+	UserID  int64           `json:"userId,omitempty"`
+	Exclude int64           `json:"exclude,omitempty"` // user whose connections are skipped, 0 for none
+	Data    json.RawMessage `json:"data,omitempty"`
+	// users whose connections start or stop receiving the chat's broadcasts
+	Join  []int64 `json:"join,omitempty"`
+	Leave []int64 `json:"leave,omitempty"`
+}
+
+type HubManager struct {
+	db     *sql.DB
+	broker Broker
+
+	mu    sync.Mutex
+	hubs  map[int64]*Hub
+	users map[int64]map[*Client]bool // open connections per user
+
+	typingMu sync.Mutex
+	typing   map[typingKey]*typingState
+}
+
+type typingKey struct {
+	chatID int64
+	userID int64
+}
+
+type typingState struct {
+	lastSent time.Time
+	expiry   *time.Timer
 }
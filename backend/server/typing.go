@@ -0,0 +1,131 @@
+package server
+
+import "time"
+
+const (
+	// typingTimeout is how long a typing.start stays valid without a new one
+	// before the other members get a typing.stop.
+	typingTimeout = 6 * time.Second
+	// typingThrottle is the minimum time between two typing.start events
+	// relayed for the same user in the same chat.
+	typingThrottle = 3 * time.Second
+)
+
+type TypingPayload struct {
+	UserID int64 `json:"userId"`
+}
+
+func init() {
+	registerCommand(CommandTypingStart, handleTypingCommand)
+	registerCommand(CommandTypingStop, handleTypingCommand)
+}
+
+func handleTypingCommand(client *Client, env Envelope) error {
+	if !client.hubs.isSubscribed(client, env.ChatID) {
+		return newWsError(ErrorCodeNotMember, "not a member of this chat")
+	}
+
+	if env.Type == CommandTypingStart {
+		// read only members, e.g. channel subscribers, have nothing to type
+		if err := checkPermission(client.db, env.ChatID, client.id, PermissionSendMessages); err != nil {
+			return messageWsError(err)
+		}
+		client.hubs.startTyping(env.ChatID, client.id)
+	} else {
+		client.hubs.stopTyping(env.ChatID, client.id)
+	}
+
+	return nil
+}
+
+// startTyping relays typing.start to the other members of the chat, at most
+// once per typingThrottle, and (re)arms the automatic typing.stop.
+func (m *HubManager) startTyping(chatID, userID int64) {
+	key := typingKey{chatID: chatID, userID: userID}
+
+	m.typingMu.Lock()
+	state, ok := m.typing[key]
+	if !ok {
+		newState := &typingState{}
+		newState.expiry = time.AfterFunc(typingTimeout, func() {
+			m.expireTyping(key, newState)
+		})
+		state = newState
+		m.typing[key] = state
+	} else {
+		state.expiry.Reset(typingTimeout)
+	}
+
+	relay := time.Since(state.lastSent) >= typingThrottle
+	if relay {
+		state.lastSent = time.Now()
+	}
+	m.typingMu.Unlock()
+
+	if relay {
+		m.publishTyping(chatID, userID, EventTypingStart)
+	}
+}
+
+// stopTyping clears the typing state of the user and tells the other members.
+// It does nothing if the user isn't typing.
+func (m *HubManager) stopTyping(chatID, userID int64) {
+	key := typingKey{chatID: chatID, userID: userID}
+
+	m.typingMu.Lock()
+	state, ok := m.typing[key]
+	if ok {
+		state.expiry.Stop()
+		delete(m.typing, key)
+	}
+	m.typingMu.Unlock()
+
+	if ok {
+		m.publishTyping(chatID, userID, EventTypingStop)
+	}
+}
+
+// stopUserTyping ends every typing session of the user, e.g. when their
+// last connection drops before it could send typing.stop.
+func (m *HubManager) stopUserTyping(userID int64) {
+	stopped := []int64{}
+
+	m.typingMu.Lock()
+	for key, state := range m.typing {
+		if key.userID == userID {
+			state.expiry.Stop()
+			delete(m.typing, key)
+			stopped = append(stopped, key.chatID)
+		}
+	}
+	m.typingMu.Unlock()
+
+	for _, chatID := range stopped {
+		m.publishTyping(chatID, userID, EventTypingStop)
+	}
+}
+
+// expireTyping is called by the expiry timer. The state is compared so a
+// timer that fired while being stopped can't end a newer typing session.
+func (m *HubManager) expireTyping(key typingKey, state *typingState) {
+	m.typingMu.Lock()
+	current, ok := m.typing[key]
+	expired := ok && current == state
+	if expired {
+		delete(m.typing, key)
+	}
+	m.typingMu.Unlock()
+
+	if expired {
+		m.publishTyping(key.chatID, key.userID, EventTypingStop)
+	}
+}
+
+func (m *HubManager) publishTyping(chatID, userID int64, eventType string) {
+	data, err := newEvent(eventType, chatID, TypingPayload{UserID: userID})
+	if err != nil {
+		return
+	}
+
+	m.broadcastExcept(chatID, userID, data)
+}
@@ -2,10 +2,13 @@ package server
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
@@ -13,7 +16,10 @@ import (
 	verify "github.com/twilio/twilio-go/rest/verify/v2"
 )
 
-func addUserRoutes(router *gin.RouterGroup, db *sql.DB) {
+// tokenLifetime is how long a token issued by `verifyOTP` stays valid.
+const tokenLifetime = 30 * 24 * time.Hour
+
+func addUserRoutes(router *gin.RouterGroup, db *sql.DB, hubs *HubManager) {
 	user := router.Group("/user")
 	{
 		user.POST("/send-otp", func(c *gin.Context) {
@@ -26,7 +32,7 @@ func addUserRoutes(router *gin.RouterGroup, db *sql.DB) {
 		user.Use(authMiddleWare)
 
 		user.GET("/me", func(c *gin.Context) {
-			getMe(c, db)
+			getMe(c, db, hubs)
 		})
 
 		user.POST("/me", func(c *gin.Context) {
@@ -36,13 +42,26 @@ func addUserRoutes(router *gin.RouterGroup, db *sql.DB) {
 		user.PUT("/me", func(c *gin.Context) {
 			updateMe(c, db)
 		})
+
+		user.GET("/:id", func(c *gin.Context) {
+			getUser(c, db, hubs)
+		})
 	}
 }
 
+// tokenErrorMessage turns a `parseToken` error into the message sent to the client.
+func tokenErrorMessage(err error) string {
+	if errors.Is(err, errTokenExpired) {
+		return "token expired"
+	}
+
+	return "invalid token"
+}
+
 func authMiddleWare(c *gin.Context) {
 	auth := c.Request.Header.Get("Authorization")
 	if auth == "" {
-		c.JSON(401, gin.H{"error": "Authorization header required"})
+		c.JSON(401, gin.H{"error": "Authorization header required", "code": ErrorCodeUnauthorized})
 		c.Abort()
 		return
 	}
@@ -52,7 +71,7 @@ func authMiddleWare(c *gin.Context) {
 	// so that the next handler can access it
 	userId, err := parseToken(auth)
 	if err != nil {
-		c.JSON(401, gin.H{"error": "invalid token"})
+		c.JSON(401, gin.H{"error": tokenErrorMessage(err), "code": ErrorCodeUnauthorized})
 		c.Abort()
 		return
 	}
@@ -62,6 +81,8 @@ func authMiddleWare(c *gin.Context) {
 	c.Next()
 }
 
+var errTokenExpired = errors.New("token expired")
+
 // The function `parseToken` takes in a string parameter called `authString`.
 // It splits the string into two parts using the space character as a separator.
 func parseToken(authString string) (string, error) {
@@ -77,11 +98,17 @@ func parseToken(authString string) (string, error) {
 		return "", fmt.Errorf("invalid token")
 	}
 
+	return parseTokenString(parsedData[1])
+}
+
+// The function `parseTokenString` validates a raw JWT and returns the `userId` claim.
+// Expired tokens are reported with `errTokenExpired` so callers can tell the client to log in again.
+func parseTokenString(tokenString string) (string, error) {
 	// Here we get our secret key from the environment variables.
 	hmacSampleSecret := []byte(os.Getenv("JWT_SECRET"))
 
-	// We try to parse the second element of `parsedData` as JWT token, which is passed as an argument to `jwt.Parse` function.
-	tk, err := jwt.Parse(strings.Split(authString, " ")[1], func(token *jwt.Token) (interface{}, error) {
+	// We try to parse the token, which is passed as an argument to `jwt.Parse` function.
+	tk, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect:
 		// If the signing method is not HMAC, it returns an error message.
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -92,18 +119,29 @@ func parseToken(authString string) (string, error) {
 		return hmacSampleSecret, nil
 	})
 
+	if err != nil {
+		// The `exp` claim is checked by `jwt.Parse` itself, we only have to tell it apart from other errors.
+		if validationErr, ok := err.(*jwt.ValidationError); ok && validationErr.Errors&jwt.ValidationErrorExpired != 0 {
+			return "", errTokenExpired
+		}
+		return "", fmt.Errorf("invalid token: %w", err)
+	}
+
 	// If the token is valid and claims can be extracted from the token,
 	// it checks if the `userId` claim exists and returns that value as string.
-	if claims, ok := tk.Claims.(jwt.MapClaims); ok && tk.Valid {
-		if userId, ok := claims["userId"].(string); ok {
-			return userId, nil
-		} else {
-			return "", fmt.Errorf("invalid token")
-		}
-	} else {
-		// If there is an error, it prints the error and returns a nil value for the error.
-		fmt.Println(err)
-		return "", nil
+	claims, ok := tk.Claims.(jwt.MapClaims)
+	if !ok || !tk.Valid {
+		return "", fmt.Errorf("invalid token")
+	}
+
+	// Numeric claims are decoded as float64, tokens issued by `verifyOTP` carry the id as a number.
+	switch userId := claims["userId"].(type) {
+	case string:
+		return userId, nil
+	case float64:
+		return strconv.FormatInt(int64(userId), 10), nil
+	default:
+		return "", fmt.Errorf("invalid token")
 	}
 }
 
@@ -205,10 +243,10 @@ func verifyOTP(c *gin.Context, db *sql.DB) {
 	user.Phone = userVerification.Phone
 
 	// check if user exists
-	userRow := db.QueryRow(`SELECT * FROM User WHERE Phone = ?`, user.Phone)
+	err = scanUser(db.QueryRow(`SELECT `+userColumns+` FROM User WHERE Phone = ?`, user.Phone), &user)
 
 	var userId int64
-	if userRow.Err() != nil {
+	if err == sql.ErrNoRows {
 		// user doesn't exist, create a new user initiate
 		userInitiate := UserInitiate{}
 		userInitiate.Phone = user.Phone
@@ -216,47 +254,50 @@ func verifyOTP(c *gin.Context, db *sql.DB) {
 		dbResult, err := db.Exec(`INSERT INTO UserInitiate (Phone) VALUES (?)`, userInitiate.Phone)
 		if err != nil {
 			c.JSON(500, gin.H{"error": "error verifying user"})
+			return
 		}
 
 		id, err := dbResult.LastInsertId()
 		if err != nil {
 			c.JSON(500, gin.H{"error": "error verifying user"})
+			return
 		}
 
 		userId = id
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": "error verifying user"})
+		return
 	} else {
 		// user exists, get the user id
-		err = userRow.Scan(&user.ID, &user.FullName, &user.AvatarLink, &user.Phone)
-		if err != nil {
-			c.JSON(500, gin.H{"error": "error verifying user"})
-		}
-
 		userId = user.ID
 	}
 
 	// create a new token with secret
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"userId": userId,
+		"exp":    time.Now().Add(tokenLifetime).Unix(),
 	})
 
 	//send the token back to the client
 	signedToken, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
 	if err != nil {
 		c.JSON(500, gin.H{"error": "error verifying user"})
+		return
 	}
 
 	c.JSON(200, gin.H{"token": signedToken, "success": success})
 }
 
-func getMe(c *gin.Context, db *sql.DB) {
+func getMe(c *gin.Context, db *sql.DB, hubs *HubManager) {
 	userId := c.GetString("userId")
 
-	userRow := db.QueryRow(`
-		SELECT * FROM User
+	user := User{}
+	err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+` FROM User
 		WHERE ID = ?
-		`, userId)
+		`, userId), &user)
 
-	if userRow.Err() != nil {
+	if err == sql.ErrNoRows {
 		userInitiateRow := db.QueryRow(`
 		SELECT * FROM UserInitiate
 		WHERE ID = ?
@@ -270,17 +311,109 @@ func getMe(c *gin.Context, db *sql.DB) {
 		}
 
 		c.JSON(200, gin.H{"user": userInitiate, "initiate": true})
+		return
+	}
+
+	if err != nil {
+		log.Printf("error getting user: %s", err.Error())
+		c.JSON(500, gin.H{"error": "error getting user"})
+		return
+	}
+
+	// the user always sees their own presence, whatever the privacy setting
+	user.Online = hubs.isOnline(user.ID)
+
+	c.JSON(200, gin.H{"user": user, "initiate": false})
+}
+
+// getUser returns another user's public profile. Presence is only included
+// when the user's LastSeenPrivacy allows the caller to see it.
+func getUser(c *gin.Context, db *sql.DB, hubs *HubManager) {
+	viewerId, err := strconv.ParseInt(c.GetString("userId"), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "invalid token"})
+		return
 	}
 
 	user := User{}
+	err = scanUser(db.QueryRow(`SELECT `+userColumns+` FROM User WHERE ID = ?`, c.Param("id")), &user)
+	if err == sql.ErrNoRows {
+		c.JSON(404, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("error getting user: %s", err.Error())
+		c.JSON(500, gin.H{"error": "error getting user"})
+		return
+	}
 
-	err := userRow.Scan(&user.ID, &user.FullName, &user.AvatarLink, &user.Handle, &user.Phone)
+	visible, err := canSeePresence(db, viewerId, user)
 	if err != nil {
+		log.Printf("error checking presence privacy: %s", err.Error())
 		c.JSON(500, gin.H{"error": "error getting user"})
 		return
 	}
 
-	c.JSON(200, gin.H{"user": user, "initiate": false})
+	if visible {
+		user.Online = hubs.isOnline(user.ID)
+	} else {
+		user.LastSeen = nil
+	}
+	// the privacy setting and the phone number are only shown to the user themselves
+	user.LastSeenPrivacy = ""
+	user.Phone = ""
+
+	c.JSON(200, gin.H{"user": user})
+}
+
+// canSeePresence tells whether viewerId may see the online state and last
+// seen time of user.
+func canSeePresence(db *sql.DB, viewerId int64, user User) (bool, error) {
+	if viewerId == user.ID {
+		return true, nil
+	}
+
+	switch user.LastSeenPrivacy {
+	case LastSeenEveryone:
+		return true, nil
+	case LastSeenChats:
+		return shareChat(db, viewerId, user.ID)
+	default:
+		return false, nil
+	}
+}
+
+// shareChat tells whether both users are members of at least one common
+// chat other than a channel.
+func shareChat(db *sql.DB, userId, otherUserId int64) (bool, error) {
+	var shared bool
+	err := db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM ChatMember a
+			JOIN ChatMember b ON b.ChatID = a.ChatID
+			JOIN Chat c ON c.ID = a.ChatID
+			WHERE a.UserID = ? AND b.UserID = ? AND c.ChatType <> ?
+		)`, userId, otherUserId, ChatTypeChannel).Scan(&shared)
+
+	return shared, err
+}
+
+// userColumns lists the User columns in the order scanUser reads them.
+const userColumns = `ID, FullName, Handle, Phone, COALESCE(AvatarLink, ''), LastSeen, LastSeenPrivacy`
+
+func scanUser(row interface{ Scan(...interface{}) error }, user *User) error {
+	var lastSeen sql.NullString
+	err := row.Scan(&user.ID, &user.FullName, &user.Handle, &user.Phone, &user.AvatarLink, &lastSeen, &user.LastSeenPrivacy)
+	if err != nil {
+		return err
+	}
+
+	user.LastSeen = nil
+	if lastSeen.Valid {
+		user.LastSeen = &lastSeen.String
+	}
+
+	return nil
 }
 
 func updateMe(c *gin.Context, db *sql.DB) {
@@ -310,14 +443,12 @@ func updateMe(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	userRow := db.QueryRow(`
-				SELECT * FROM User
-				WHERE ID = ?
-				`, userId)
-
 	user := User{}
 
-	err = userRow.Scan(&user.ID, &user.FullName, &user.AvatarLink, &user.Handle, &user.Phone)
+	err = scanUser(db.QueryRow(`
+				SELECT `+userColumns+` FROM User
+				WHERE ID = ?
+				`, userId), &user)
 
 	if err != nil {
 		log.Printf("error getting user data: %s", err.Error())
@@ -341,11 +472,19 @@ func updateMe(c *gin.Context, db *sql.DB) {
 		user.Phone = userUpdateData.Phone
 	}
 
+	if userUpdateData.LastSeenPrivacy != "" {
+		if !isValidLastSeenPrivacy(userUpdateData.LastSeenPrivacy) {
+			c.JSON(400, gin.H{"success": false, "error": "invalid lastSeenPrivacy"})
+			return
+		}
+		user.LastSeenPrivacy = userUpdateData.LastSeenPrivacy
+	}
+
 	res, err := db.Exec(`
 				UPDATE User
-				SET FullName = ?, AvatarLink = ?, Handle = ?, Phone = ?
+				SET FullName = ?, AvatarLink = ?, Handle = ?, Phone = ?, LastSeenPrivacy = ?
 				WHERE ID = ?
-		`, user.FullName, user.AvatarLink, user.Handle, user.Phone, user.ID)
+		`, user.FullName, user.AvatarLink, user.Handle, user.Phone, user.LastSeenPrivacy, user.ID)
 
 	if err != nil {
 		log.Printf("error updating user: %s", err.Error())
@@ -431,14 +570,12 @@ func createMe(c *gin.Context, db *sql.DB) {
 		return
 	}
 
-	userRow := db.QueryRow(`
-				SELECT * FROM User
-				WHERE ID = ?
-		`, id)
-
 	user := User{}
 
-	err = userRow.Scan(&user.ID, &user.FullName, &user.AvatarLink, &user.Handle, &user.Phone)
+	err = scanUser(db.QueryRow(`
+				SELECT `+userColumns+` FROM User
+				WHERE ID = ?
+		`, id), &user)
 
 	if err != nil {
 		log.Printf("error reading user data: %s", err.Error())
@@ -3,6 +3,10 @@ package server
 import (
 	"errors"
 	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
 )
 
 func validatePhoneNumber(phoneNumber string) (bool, error) {
@@ -13,3 +17,56 @@ func validatePhoneNumber(phoneNumber string) (bool, error) {
 
 	return true, nil
 }
+
+var handleRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{4,31}$`)
+
+func isValidHandle(handle string) bool {
+	return handleRegexp.MatchString(handle)
+}
+
+func isValidLastSeenPrivacy(privacy string) bool {
+	switch privacy {
+	case LastSeenEveryone, LastSeenChats, LastSeenNobody:
+		return true
+	}
+
+	return false
+}
+
+// getUserId returns the ID of the authenticated user set by authMiddleWare.
+// If it is missing it answers 401 and returns false.
+func getUserId(c *gin.Context) (int64, bool) {
+	userId, err := strconv.ParseInt(c.GetString("userId"), 10, 64)
+	if err != nil {
+		c.JSON(401, gin.H{"success": false, "error": "invalid token", "code": ErrorCodeUnauthorized})
+		return 0, false
+	}
+
+	return userId, true
+}
+
+// getIdParam parses a numeric path parameter. If it isn't a number it answers
+// 400 and returns false.
+func getIdParam(c *gin.Context, name string) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param(name), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"success": false, "error": "invalid " + name})
+		return 0, false
+	}
+
+	return id, true
+}
+
+// placeholders returns n comma separated "?" for an IN (...) clause.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func int64Args(values []int64) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+
+	return args
+}